@@ -0,0 +1,102 @@
+package firebase_verify_token
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultAuthzTimeout = 2 * time.Second
+
+// authzClient asks an external policy engine such as OPA whether a verified request may
+// proceed. The request body follows OPA's data API:
+//
+//	{"input": {"token": {...all claims...}, "path": "/api/x", "method": "GET"}}
+//
+// and the engine answers {"result": true} or {"result": {"allow": true}}.
+type authzClient struct {
+	name     string
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+type authzInput struct {
+	Token  map[string]interface{} `json:"token"`
+	Path   string                 `json:"path"`
+	Method string                 `json:"method"`
+}
+
+// authzUnavailableError indicates that the policy engine could not be asked about a request,
+// which says nothing about the token itself.
+type authzUnavailableError struct {
+	err error
+}
+
+func (e *authzUnavailableError) Error() string {
+	return "policy engine unavailable: " + e.err.Error()
+}
+
+func (e *authzUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// authorize returns an authorizationError when the engine denies the request. Errors reaching
+// the engine deny the request too, with an authzUnavailableError, unless failOpen is set.
+func (a *authzClient) authorize(req *http.Request, token *Token) error {
+	requestPath := cleanPath(req.URL.Path)
+	allowed, err := a.query(req.Context(), authzInput{Token: token.AllClaims(), Path: requestPath, Method: req.Method})
+	if err != nil {
+		if a.failOpen {
+			log.Printf("%s: WARNING: allowing request to %s, policy engine unavailable: %v", a.name, requestPath, err)
+			return nil
+		}
+		return &authzUnavailableError{err}
+	}
+	if !allowed {
+		return &authorizationError{"denied by the policy engine"}
+	}
+	return nil
+}
+
+func (a *authzClient) query(ctx context.Context, input authzInput) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Result interface{} `json:"result"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return false, fmt.Errorf("invalid response: %v", err)
+	}
+	switch r := result.Result.(type) {
+	case bool:
+		return r, nil
+	case map[string]interface{}:
+		allow, _ := r["allow"].(bool)
+		return allow, nil
+	}
+	// An undefined decision, e.g. a missing rule, is a deny.
+	return false, nil
+}
@@ -0,0 +1,98 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthz(t *testing.T) {
+	engine := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			Input authzInput `json:"input"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("invalid request to the policy engine: %v", err)
+		}
+		switch {
+		case strings.HasPrefix(body.Input.Path, "/broken/"):
+			http.Error(rw, "boom", http.StatusInternalServerError)
+		case strings.HasPrefix(body.Input.Path, "/admin/"):
+			rw.Write([]byte(`{"result": {"allow": false}}`))
+		default:
+			rw.Write([]byte(`{"result": true}`))
+		}
+	}))
+	defer engine.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		path     string
+		want     int
+		wantCode string
+	}{
+		{"allowed", engine.URL, "/api/x", http.StatusOK, ""},
+		{"denied", engine.URL, "/admin/x", http.StatusForbidden, errorCodeClaimDenied},
+		{"denied after cleaning the path", engine.URL, "/api/../admin/x", http.StatusForbidden, errorCodeClaimDenied},
+		{"error response", engine.URL, "/broken/x", http.StatusServiceUnavailable, errorCodeAuthzUnavailable},
+		{"unreachable", down.URL, "/api/x", http.StatusServiceUnavailable, errorCodeAuthzUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.AuthzURL = tt.url
+			cfg.JSONErrors = true
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path = tt.path
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rw.Code, tt.want)
+			}
+			if tt.wantCode != "" && !strings.Contains(rw.Body.String(), `"`+tt.wantCode+`"`) {
+				t.Errorf("body = %s, want error %q", rw.Body.String(), tt.wantCode)
+			}
+			if challenge := rw.Header().Get("WWW-Authenticate"); strings.Contains(challenge, "invalid_token") {
+				t.Errorf("WWW-Authenticate = %q, the token is not at fault", challenge)
+			}
+		})
+	}
+}
+
+func TestAuthzUnavailableGRPC(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.AuthzURL = down.URL
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("request was forwarded")
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if status := rw.Header().Get("Grpc-Status"); status != "14" {
+		t.Errorf("Grpc-Status = %q, want %q", status, "14")
+	}
+}
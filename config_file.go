@@ -0,0 +1,111 @@
+package firebase_verify_token
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultConfigFileInterval = 10 * time.Second
+
+// watchConfigFile polls base.ConfigFile until the plugin is closed and reloads the plugin
+// whenever the file's size or modification time differs from the last version read, described
+// by loaded. Errors are logged and leave the current configuration in place.
+func (ctl *FirebaseJwtPlugin) watchConfigFile(base *Config, interval time.Duration, loaded os.FileInfo) {
+	name := ctl.current().name
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastMod, lastSize := loaded.ModTime(), loaded.Size()
+	for {
+		select {
+		case <-ctl.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if fi, err := os.Stat(base.ConfigFile); err != nil {
+			log.Printf("%s: cannot read ConfigFile: %v", name, err)
+		} else if !fi.ModTime().Equal(lastMod) || fi.Size() != lastSize {
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+			cfg, err := loadConfigFile(base)
+			if err == nil {
+				err = ctl.Reload(cfg)
+			}
+			if err != nil {
+				log.Printf("%s: keeping the current configuration, cannot apply %s: %v", name, base.ConfigFile, err)
+			} else {
+				log.Printf("%s: applied configuration from %s", name, base.ConfigFile)
+			}
+		}
+	}
+}
+
+// readConfigFile loads base.ConfigFile for New, returning the merged configuration along with
+// the state of the file before it was read.
+func readConfigFile(base *Config) (*Config, os.FileInfo, error) {
+	fi, err := os.Stat(base.ConfigFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuration incorrect, cannot read ConfigFile: %v", err)
+	}
+	cfg, err := loadConfigFile(base)
+	if err != nil {
+		return nil, nil, fmt.Errorf("configuration incorrect, cannot apply ConfigFile %s: %v", base.ConfigFile, err)
+	}
+	return cfg, fi, nil
+}
+
+// loadConfigFile returns base with the options from base.ConfigFile applied on top of it.
+// Options that cannot be expressed in JSON, such as KeySource and the hooks, are kept from
+// base.
+func loadConfigFile(base *Config) (*Config, error) {
+	data, err := os.ReadFile(base.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	// Round-trip base through JSON so the file cannot alias its slices and maps.
+	baseJSON, err := json.Marshal(base)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(baseJSON, cfg); err != nil {
+		return nil, err
+	}
+	var options map[string]json.RawMessage
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	// An option set in the file replaces that of base. json.Unmarshal would merge objects into
+	// the maps of base, and array elements into the structs already in its slices, so those
+	// options are cleared first. Keys match field names case-insensitively, as in Unmarshal.
+	resets := []struct {
+		name  string
+		reset func()
+	}{
+		{"StaticPublicKeysPEM", func() { cfg.StaticPublicKeysPEM = nil }},
+		{"ErrorTemplates", func() { cfg.ErrorTemplates = nil }},
+		{"RequiredClaims", func() { cfg.RequiredClaims = nil }},
+		{"Groups", func() { cfg.Groups = nil }},
+		{"Policies", func() { cfg.Policies = nil }},
+		{"ClaimHeaderMap", func() { cfg.ClaimHeaderMap = nil }},
+		{"ClaimEncodings", func() { cfg.ClaimEncodings = nil }},
+	}
+	for key := range options {
+		for _, option := range resets {
+			if strings.EqualFold(key, option.name) {
+				option.reset()
+			}
+		}
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	cfg.KeySource = base.KeySource
+	cfg.OnDecision = base.OnDecision
+	cfg.OnUnauthorized = base.OnUnauthorized
+	return cfg, nil
+}
@@ -0,0 +1,212 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigFileAppliedByNew(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"BlockedUIDs": ["user-1"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.ConfigFile = configFile
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("blocked user was forwarded")
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.(*FirebaseJwtPlugin).Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusForbidden)
+	}
+}
+
+func TestInvalidConfigFileFailsNew(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{"missing", ""},
+		{"invalid JSON", `{"BlockedUIDs": [`},
+		{"invalid option", `{"ProjectID": "x"}`},
+		{"wrong type", `{"BlockedUIDs": "user-1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(dir, tt.name+".json")
+			if tt.contents != "" {
+				if err := os.WriteFile(configFile, []byte(tt.contents), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.ConfigFile = configFile
+			if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("New accepted an invalid ConfigFile")
+			}
+		})
+	}
+}
+
+func TestConfigFileReloadedOnChange(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	write := func(contents string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		// Set the time explicitly, as coarse file system timestamps may not change otherwise.
+		if err := os.Chtimes(configFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write(`{"BlockedUIDs": ["someone-else"]}`, start)
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.ConfigFile = configFile
+	cfg.ConfigFileInterval = "10ms"
+	plugin := newTestPlugin(t, cfg)
+	defer plugin.Close()
+	initial := plugin.current()
+
+	// The file New applied is not applied again.
+	time.Sleep(50 * time.Millisecond)
+	if plugin.current() != initial {
+		t.Error("the unchanged ConfigFile was reloaded")
+	}
+
+	write(`{"BlockedUIDs": ["user-1"]}`, start.Add(time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for !containsString(plugin.current().blockedUIDs, "user-1") {
+		if time.Now().After(deadline) {
+			t.Fatalf("BlockedUIDs = %v after changing the ConfigFile", plugin.current().blockedUIDs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An invalid file is ignored.
+	applied := plugin.current()
+	write(`{"ProjectID": "x"}`, start.Add(2*time.Minute))
+	time.Sleep(100 * time.Millisecond)
+	if plugin.current() != applied {
+		t.Error("an invalid ConfigFile replaced the configuration")
+	}
+}
+
+func TestConfigFileReplacesMapsAndSlices(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{
+		"RequiredClaims": {"tier": "free"},
+		"claimheadermap": {"b": "X-B"},
+		"BlockedUIDs": ["z"],
+		"Policies": [{"Path": "/ops/*"}]
+	}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	base := CreateConfig()
+	base.ProjectID = testProjectID
+	base.ConfigFile = configFile
+	base.RequiredClaims = map[string]interface{}{"tier": "paid", "role": "admin"}
+	base.ClaimHeaderMap = map[string]string{"a": "X-A"}
+	base.ClaimEncodings = map[string]string{"a": claimEncodingBase64}
+	base.BlockedUIDs = []string{"x", "y"}
+	base.Policies = []Policy{{Path: "/admin/*", Methods: []string{http.MethodGet}, RequiredClaims: map[string]interface{}{"role": "admin"}}}
+	cfg, err := loadConfigFile(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]interface{}{"tier": "free"}; !reflect.DeepEqual(cfg.RequiredClaims, want) {
+		t.Errorf("RequiredClaims = %v, want %v", cfg.RequiredClaims, want)
+	}
+	if want := map[string]string{"b": "X-B"}; !reflect.DeepEqual(cfg.ClaimHeaderMap, want) {
+		t.Errorf("ClaimHeaderMap = %v, want %v", cfg.ClaimHeaderMap, want)
+	}
+	if want := []string{"z"}; !reflect.DeepEqual(cfg.BlockedUIDs, want) {
+		t.Errorf("BlockedUIDs = %v, want %v", cfg.BlockedUIDs, want)
+	}
+	if want := []Policy{{Path: "/ops/*"}}; !reflect.DeepEqual(cfg.Policies, want) {
+		t.Errorf("Policies = %+v, want %+v", cfg.Policies, want)
+	}
+	// Options the file does not set are kept.
+	if want := map[string]string{"a": claimEncodingBase64}; !reflect.DeepEqual(cfg.ClaimEncodings, want) {
+		t.Errorf("ClaimEncodings = %v, want %v", cfg.ClaimEncodings, want)
+	}
+	if len(base.RequiredClaims) != 2 || len(base.ClaimHeaderMap) != 1 || len(base.Policies[0].RequiredClaims) != 1 {
+		t.Errorf("loadConfigFile modified base: %+v", base)
+	}
+}
+
+func TestReloadUntilConfigFileChanges(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	write := func(contents string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(configFile, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write(`{}`, start)
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.ConfigFile = configFile
+	cfg.ConfigFileInterval = "10ms"
+	plugin := newTestPlugin(t, cfg)
+	defer plugin.Close()
+
+	reloaded := CreateConfig()
+	reloaded.ProjectID = testProjectID
+	reloaded.KeySource = testKeySource()
+	reloaded.BlockedUIDs = []string{"user-1"}
+	if err := plugin.Reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	// Polling an unchanged file keeps the reloaded configuration.
+	time.Sleep(50 * time.Millisecond)
+	if blocked := plugin.current().blockedUIDs; !containsString(blocked, "user-1") {
+		t.Fatalf("BlockedUIDs = %v, the reloaded configuration was replaced", blocked)
+	}
+
+	// A change to the file applies it on top of the configuration passed to New.
+	write(`{"AllowedTenants": ["tenant-a"]}`, start.Add(time.Minute))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(plugin.current().allowedTenants) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the changed ConfigFile was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if blocked := plugin.current().blockedUIDs; len(blocked) != 0 {
+		t.Errorf("BlockedUIDs = %v, want those of the configuration passed to New", blocked)
+	}
+}
@@ -0,0 +1,31 @@
+package firebase_verify_token
+
+import "context"
+
+type contextKey struct {
+	name string
+}
+
+// TokenContextKey is the context key under which ServeHTTP stores the verified *Token before
+// calling the next handler.
+var TokenContextKey = &contextKey{"firebase-token"}
+
+// externalKeyIDContextKey carries a key id supplied outside of the token itself.
+var externalKeyIDContextKey = &contextKey{"external-key-id"}
+
+// TokenFromContext returns the verified Token stored in ctx by ServeHTTP, if any.
+func TokenFromContext(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(TokenContextKey).(*Token)
+	return token, ok && token != nil
+}
+
+// withExternalKeyID returns a context carrying the key id to verify tokens without a 'kid'
+// header against.
+func withExternalKeyID(ctx context.Context, kid string) context.Context {
+	return context.WithValue(ctx, externalKeyIDContextKey, kid)
+}
+
+func externalKeyIDFromContext(ctx context.Context) string {
+	kid, _ := ctx.Value(externalKeyIDContextKey).(string)
+	return kid
+}
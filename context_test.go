@@ -0,0 +1,60 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenFromContext(t *testing.T) {
+	if _, ok := TokenFromContext(context.Background()); ok {
+		t.Error("TokenFromContext found a token in an empty context")
+	}
+	ctx := context.WithValue(context.Background(), TokenContextKey, (*Token)(nil))
+	if _, ok := TokenFromContext(ctx); ok {
+		t.Error("TokenFromContext reported a nil token")
+	}
+}
+
+func TestServeHTTPStoresTokenInContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"valid token", "Bearer " + mintTestToken(t, map[string]interface{}{"role": "admin"}), true},
+		{"invalid token", "Bearer not-a-jwt", false},
+		{"no token", "", false},
+	}
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	// Dry-run forwards failed requests too, so their context can be inspected.
+	cfg.EnforceMode = enforceModeDryRun
+	var token *Token
+	var found bool
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token, found = TokenFromContext(req.Context())
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if found != tt.want {
+				t.Fatalf("TokenFromContext() found = %v, want %v", found, tt.want)
+			}
+			if found && (token.UID != "user-1" || token.Claims["role"] != "admin") {
+				t.Errorf("token in context = %+v", token)
+			}
+		})
+	}
+}
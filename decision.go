@@ -0,0 +1,83 @@
+package firebase_verify_token
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+)
+
+// Reasons of the requests ServeHTTP forwards without verification.
+const (
+	bypassPreflight = "CORS preflight"
+	bypassOptions   = "OPTIONS request without a token"
+	bypassOptional  = "optional authentication without a token"
+	bypassPublic    = "public route without a token"
+)
+
+// DecisionEvent describes an access decision taken by ServeHTTP.
+type DecisionEvent struct {
+	Time       time.Time
+	RemoteAddr string
+	Path       string
+	// Decision is "allow" when the request was forwarded and "deny" when it was rejected.
+	Decision string
+	// Reason is the verification error, if any. It is also set for requests that were
+	// forwarded despite an error, e.g. in dry-run mode, and for requests forwarded without
+	// verification, e.g. "public route without a token".
+	Reason string
+	// UID is only set when the token was successfully verified.
+	UID string
+	// KeyID is the 'kid' header of the presented token, if it could be decoded.
+	KeyID string
+}
+
+// emitDecision reports the decision taken for req to the configured OnDecision hook.
+func (st *settings) emitDecision(req *http.Request, token *Token, err error, allowed bool) {
+	if st.onDecision == nil {
+		return
+	}
+
+	event := st.newDecisionEvent(req)
+	if allowed {
+		event.Decision = decisionAllow
+	}
+	if err != nil {
+		event.Reason = err.Error()
+	} else if token != nil {
+		event.UID = token.UID
+	}
+	st.onDecision(event)
+}
+
+// emitBypass reports a request that was forwarded without verification, with reason naming
+// the rule that let it through.
+func (st *settings) emitBypass(req *http.Request, reason string) {
+	if st.onDecision == nil {
+		return
+	}
+
+	event := st.newDecisionEvent(req)
+	event.Decision = decisionAllow
+	event.Reason = reason
+	st.onDecision(event)
+}
+
+// newDecisionEvent returns a deny event for req.
+func (st *settings) newDecisionEvent(req *http.Request) DecisionEvent {
+	event := DecisionEvent{
+		Time:       time.Now(),
+		RemoteAddr: req.RemoteAddr,
+		Path:       req.URL.Path,
+		Decision:   decisionDeny,
+	}
+	if raw, err := st.extractToken(req); err == nil {
+		if jwt, parseErr := parseJWT(*raw); parseErr == nil {
+			event.KeyID = jwt.header.KeyID
+		}
+	}
+	return event
+}
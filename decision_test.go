@@ -0,0 +1,73 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOnDecision(t *testing.T) {
+	preflight := func(req *http.Request) {
+		req.Method = http.MethodOptions
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	tests := []struct {
+		name       string
+		config     func(*Config)
+		request    func(*http.Request)
+		wantAllow  bool
+		wantReason string
+		wantUID    string
+	}{
+		{"verified token", func(*Config) {}, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+		}, true, "", "user-1"},
+		{"missing token", func(*Config) {}, func(*http.Request) {}, false, errTokenNotFound.Error(), ""},
+		{"AllowPreflight", func(cfg *Config) { cfg.AllowPreflight = true }, preflight, true, bypassPreflight, ""},
+		{"SkipOptions", func(cfg *Config) { cfg.SkipOptions = true }, func(req *http.Request) {
+			req.Method = http.MethodOptions
+		}, true, bypassOptions, ""},
+		{"Optional", func(cfg *Config) { cfg.Optional = true }, func(*http.Request) {}, true, bypassOptional, ""},
+		{"Public policy", func(cfg *Config) {
+			cfg.Policies = []Policy{{Path: "/*", Public: true}}
+		}, func(*http.Request) {}, true, bypassPublic, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []DecisionEvent
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.OnDecision = func(event DecisionEvent) {
+				events = append(events, event)
+			}
+			tt.config(cfg)
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/x", nil)
+			tt.request(req)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if len(events) != 1 {
+				t.Fatalf("got %d decision events, want 1", len(events))
+			}
+			event := events[0]
+			if wantDecision := map[bool]string{true: decisionAllow, false: decisionDeny}[tt.wantAllow]; event.Decision != wantDecision {
+				t.Errorf("Decision = %q, want %q", event.Decision, wantDecision)
+			}
+			if event.Reason != tt.wantReason {
+				t.Errorf("Reason = %q, want %q", event.Reason, tt.wantReason)
+			}
+			if event.UID != tt.wantUID {
+				t.Errorf("UID = %q, want %q", event.UID, tt.wantUID)
+			}
+			if event.Path != "/x" {
+				t.Errorf("Path = %q, want %q", event.Path, "/x")
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package firebase_verify_token
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandEnv returns a copy of config with ${NAME} placeholders in its string options replaced
+// by the value of the environment variable NAME, so one dynamic configuration can be promoted
+// across environments. Only the braced form is expanded, leaving a bare $ in secrets and PEM
+// blocks alone. Referencing an unset variable is a configuration error.
+func (config *Config) expandEnv() (*Config, error) {
+	c := *config
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"HeaderName", &c.HeaderName},
+		{"CookieName", &c.CookieName},
+		{"QueryParam", &c.QueryParam},
+		{"FormField", &c.FormField},
+		{"WebSocketProtocol", &c.WebSocketProtocol},
+		{"TokenSourceHeader", &c.TokenSourceHeader},
+		{"UIDHeader", &c.UIDHeader},
+		{"ClaimHeaderPrefix", &c.ClaimHeaderPrefix},
+		{"ProjectID", &c.ProjectID},
+		{"ProjectIDHeader", &c.ProjectIDHeader},
+		{"EnforceMode", &c.EnforceMode},
+		{"ReissueAlgorithm", &c.ReissueAlgorithm},
+		{"ReissueSecret", &c.ReissueSecret},
+		{"ReissuePrivateKey", &c.ReissuePrivateKey},
+		{"ReissueHeader", &c.ReissueHeader},
+		{"ReissueTTL", &c.ReissueTTL},
+		{"ClockSkew", &c.ClockSkew},
+		{"FutureSkew", &c.FutureSkew},
+		{"PastSkew", &c.PastSkew},
+		{"MaxTokenLifetime", &c.MaxTokenLifetime},
+		{"MaxAuthAge", &c.MaxAuthAge},
+		{"AuthzURL", &c.AuthzURL},
+		{"AuthzTimeout", &c.AuthzTimeout},
+		{"ExternalKeyIDHeader", &c.ExternalKeyIDHeader},
+		{"ProxyURL", &c.ProxyURL},
+		{"ForcedRefreshInterval", &c.ForcedRefreshInterval},
+		{"ConfigFile", &c.ConfigFile},
+		{"ConfigFileInterval", &c.ConfigFileInterval},
+		{"KeyIDHeader", &c.KeyIDHeader},
+		{"ForwardAuthMethodHeader", &c.ForwardAuthMethodHeader},
+		{"TokenJSONHeader", &c.TokenJSONHeader},
+		{"ClaimOverflow", &c.ClaimOverflow},
+		{"ClaimsHeaderMode", &c.ClaimsHeaderMode},
+		{"HeaderProfile", &c.HeaderProfile},
+		{"ClaimEncoding", &c.ClaimEncoding},
+		{"ForwardTokenHeader", &c.ForwardTokenHeader},
+		{"RolesClaim", &c.RolesClaim},
+		{"Realm", &c.Realm},
+		{"RedirectURL", &c.RedirectURL},
+		{"RedirectParam", &c.RedirectParam},
+		{"Policy", &c.Policy},
+	}
+	for _, field := range fields {
+		expanded, err := expandEnvPlaceholders(field.name, *field.value)
+		if err != nil {
+			return nil, err
+		}
+		*field.value = expanded
+	}
+
+	lists := []struct {
+		name  string
+		value *[]string
+	}{
+		{"AuthSchemes", &c.AuthSchemes},
+		{"TokenSources", &c.TokenSources},
+		{"TokenTypes", &c.TokenTypes},
+		{"ProjectIDs", &c.ProjectIDs},
+		{"ReissueClaims", &c.ReissueClaims},
+		{"ForwardClaims", &c.ForwardClaims},
+		{"AllowedIssuers", &c.AllowedIssuers},
+		{"Audiences", &c.Audiences},
+		{"AllowedRoles", &c.AllowedRoles},
+		{"AllowedProviders", &c.AllowedProviders},
+		{"AllowedUIDs", &c.AllowedUIDs},
+		{"BlockedUIDs", &c.BlockedUIDs},
+		{"AllowedTenants", &c.AllowedTenants},
+	}
+	for _, list := range lists {
+		if *list.value == nil {
+			continue
+		}
+		expanded := make([]string, len(*list.value))
+		for i, v := range *list.value {
+			var err error
+			if expanded[i], err = expandEnvPlaceholders(list.name, v); err != nil {
+				return nil, err
+			}
+		}
+		*list.value = expanded
+	}
+
+	if config.StaticPublicKeysPEM != nil {
+		c.StaticPublicKeysPEM = make(map[string]string, len(config.StaticPublicKeysPEM))
+		for kid, key := range config.StaticPublicKeysPEM {
+			expanded, err := expandEnvPlaceholders("StaticPublicKeysPEM", key)
+			if err != nil {
+				return nil, err
+			}
+			c.StaticPublicKeysPEM[kid] = expanded
+		}
+	}
+	return &c, nil
+}
+
+// expandEnvPlaceholders replaces every ${NAME} in value with the environment variable NAME.
+func expandEnvPlaceholders(option, value string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("configuration incorrect, unterminated ${ in %s", option)
+		}
+		name := value[start+2 : start+end]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("configuration incorrect, environment variable %q used in %s is not set", name, option)
+		}
+		b.WriteString(value[:start])
+		b.WriteString(env)
+		value = value[start+end+1:]
+	}
+	b.WriteString(value)
+	return b.String(), nil
+}
@@ -0,0 +1,68 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnvPlaceholders(t *testing.T) {
+	setenv(t, "FVT_TEST_PROJECT", "my-project")
+	setenv(t, "FVT_TEST_UNSET", "")
+	tests := []struct {
+		value   string
+		want    string
+		wantErr string
+	}{
+		{"${FVT_TEST_PROJECT}", "my-project", ""},
+		{"prefix-${FVT_TEST_PROJECT}-${FVT_TEST_PROJECT}", "prefix-my-project-my-project", ""},
+		{"no placeholders", "no placeholders", ""},
+		// Only the braced form is expanded.
+		{"$FVT_TEST_PROJECT and $1", "$FVT_TEST_PROJECT and $1", ""},
+		{"${FVT_TEST_UNSET}", "", `environment variable "FVT_TEST_UNSET" used in Option is not set`},
+		{"${FVT_TEST_PROJECT", "", "unterminated ${ in Option"},
+		{"${FVT_TEST_PROJECT}-${", "", "unterminated ${ in Option"},
+	}
+	for _, tt := range tests {
+		got, err := expandEnvPlaceholders("Option", tt.value)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expandEnvPlaceholders(%q) error = %v, want %q", tt.value, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandEnvPlaceholders(%q): %v", tt.value, err)
+		} else if got != tt.want {
+			t.Errorf("expandEnvPlaceholders(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	setenv(t, "FVT_TEST_PROJECT", testProjectID)
+	setenv(t, "FVT_TEST_UID", "user-2")
+	setenv(t, "FVT_TEST_UNSET", "")
+	cfg := CreateConfig()
+	cfg.ProjectID = "${FVT_TEST_PROJECT}"
+	cfg.BlockedUIDs = []string{"${FVT_TEST_UID}"}
+	expanded, err := cfg.expandEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expanded.ProjectID != testProjectID || expanded.BlockedUIDs[0] != "user-2" {
+		t.Errorf("expanded ProjectID = %q, BlockedUIDs = %q", expanded.ProjectID, expanded.BlockedUIDs)
+	}
+	// The configuration passed in is left as written.
+	if cfg.ProjectID != "${FVT_TEST_PROJECT}" || cfg.BlockedUIDs[0] != "${FVT_TEST_UID}" {
+		t.Errorf("expandEnv modified its receiver: ProjectID = %q, BlockedUIDs = %q", cfg.ProjectID, cfg.BlockedUIDs)
+	}
+
+	cfg.KeySource = testKeySource()
+	cfg.RedirectURL = "https://${FVT_TEST_UNSET}/login"
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil ||
+		!strings.Contains(err.Error(), "RedirectURL") {
+		t.Errorf("New() error = %v, want the unset variable in RedirectURL reported", err)
+	}
+}
@@ -0,0 +1,54 @@
+package firebase_verify_token_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"time"
+
+	firebase "github.com/s00rk/firebase-verify-token"
+)
+
+// This example signs a test token with a local key and verifies it offline, as tests of
+// handlers behind the middleware can do.
+func ExampleMintToken() {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Now().Unix()
+	idToken, err := firebase.MintToken(privateKey, "test-key", map[string]interface{}{
+		"iss":  "https://securetoken.google.com/my-project",
+		"aud":  "my-project",
+		"sub":  "user-1",
+		"iat":  now,
+		"exp":  now + 3600,
+		"role": "admin",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	cfg := firebase.CreateConfig()
+	cfg.ProjectID = "my-project"
+	cfg.KeySource = firebase.NewStaticKeySource([]*firebase.PublicKey{
+		{Kid: "test-key", Key: &privateKey.PublicKey},
+	})
+	handler, err := firebase.New(context.Background(), http.NotFoundHandler(), cfg, "example")
+	if err != nil {
+		panic(err)
+	}
+	plugin := handler.(*firebase.FirebaseJwtPlugin)
+	defer plugin.Close()
+
+	token, err := plugin.VerifyIDToken(context.Background(), idToken)
+	if err != nil {
+		panic(err)
+	}
+	role, _ := token.ClaimString("role")
+	fmt.Println(token.UID, role, token.KeyID)
+	// Output: user-1 admin test-key
+}
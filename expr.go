@@ -0,0 +1,488 @@
+package firebase_verify_token
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file implements the small expression language of Config.Policy. An expression
+// combines claim paths, literals and operators:
+//
+//	claims.plan == "pro" && token.email_verified
+//	"admin" in claims.roles || token.firebase.sign_in_provider != "anonymous"
+//
+// "claims" holds the custom claims of the token and "token" all of its claims, with firebase
+// as a nested object. Paths that do not exist evaluate to null. Operators, by increasing
+// precedence as in CEL, are ||, &&, the comparisons ==, !=, <, <=, >, >= and in (membership
+// in an array), + and - (on numbers; + also joins strings), and the unary ! and -, so
+// !claims.banned == true reads as (!claims.banned) == true. Arithmetic on other types yields
+// null. Literals are strings in single or double quotes with Go escapes, numbers, true,
+// false, null and arrays such as ["a", "b"].
+
+// expr is a compiled expression.
+type expr interface {
+	eval(env map[string]interface{}) interface{}
+}
+
+type literalExpr struct{ value interface{} }
+
+type pathExpr struct{ path []string }
+
+type listExpr struct{ items []expr }
+
+type notExpr struct{ x expr }
+
+type negExpr struct{ x expr }
+
+type binaryExpr struct {
+	op   string
+	l, r expr
+}
+
+func (e *literalExpr) eval(map[string]interface{}) interface{} { return e.value }
+
+func (e *pathExpr) eval(env map[string]interface{}) interface{} {
+	var value interface{} = env
+	for _, name := range e.path {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[name]
+	}
+	return value
+}
+
+func (e *listExpr) eval(env map[string]interface{}) interface{} {
+	values := make([]interface{}, len(e.items))
+	for i, item := range e.items {
+		values[i] = item.eval(env)
+	}
+	return values
+}
+
+func (e *notExpr) eval(env map[string]interface{}) interface{} {
+	return !isTrue(e.x.eval(env))
+}
+
+func (e *negExpr) eval(env map[string]interface{}) interface{} {
+	if f, ok := normalizeValue(e.x.eval(env)).(float64); ok {
+		return -f
+	}
+	return nil
+}
+
+func (e *binaryExpr) eval(env map[string]interface{}) interface{} {
+	switch e.op {
+	case "&&":
+		return isTrue(e.l.eval(env)) && isTrue(e.r.eval(env))
+	case "||":
+		return isTrue(e.l.eval(env)) || isTrue(e.r.eval(env))
+	}
+
+	l, r := normalizeValue(e.l.eval(env)), normalizeValue(e.r.eval(env))
+	switch e.op {
+	case "+", "-":
+		return arithmetic(e.op, l, r)
+	case "==":
+		return valuesEqual(l, r)
+	case "!=":
+		return !valuesEqual(l, r)
+	case "in":
+		values, ok := r.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, v := range values {
+			if valuesEqual(l, normalizeValue(v)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var cmp int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false
+		}
+		cmp = compareFloats(lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(lv, rv)
+	default:
+		return false
+	}
+	switch e.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default: // ">="
+		return cmp >= 0
+	}
+}
+
+// arithmetic applies + or - to two numbers, or + to two strings, and returns null for any
+// other operands.
+func arithmetic(op string, l, r interface{}) interface{} {
+	switch lv := l.(type) {
+	case float64:
+		if rv, ok := r.(float64); ok {
+			if op == "+" {
+				return lv + rv
+			}
+			return lv - rv
+		}
+	case string:
+		if rv, ok := r.(string); ok && op == "+" {
+			return lv + rv
+		}
+	}
+	return nil
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// normalizeValue converts the integer types used by the typed token fields to float64, the
+// type JSON numbers are decoded as.
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return value
+}
+
+// valuesEqual compares scalar values; arrays and objects are never equal.
+func valuesEqual(a, b interface{}) bool {
+	switch a.(type) {
+	case nil, string, float64, bool:
+		return a == b
+	}
+	return false
+}
+
+func isTrue(value interface{}) bool {
+	b, ok := value.(bool)
+	return ok && b
+}
+
+// expressionEnv returns the variables an expression is evaluated against for the given token.
+func expressionEnv(token *Token) map[string]interface{} {
+	all := token.AllClaims()
+	all["firebase"] = map[string]interface{}{
+		"sign_in_provider": token.Firebase.SignInProvider,
+		"tenant":           token.Firebase.Tenant,
+		"identities":       token.Firebase.Identities,
+	}
+	claims := token.Claims
+	if claims == nil {
+		claims = map[string]interface{}{}
+	}
+	return map[string]interface{}{"claims": claims, "token": all}
+}
+
+// compileExpr parses src into an expression.
+func compileExpr(src string) (expr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+type exprTokenKind int
+
+const (
+	exprIdent exprTokenKind = iota
+	exprString
+	exprNumber
+	exprOperator
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+}
+
+// exprOperators lists the operators and punctuation, longest first so that "<=" is not read
+// as "<".
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "(", ")", "[", "]", ","}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			quoted := src[i : j+1]
+			if c == '\'' {
+				quoted = singleToDoubleQuoted(src[i+1 : j])
+			}
+			s, err := strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d", i)
+			}
+			tokens = append(tokens, exprToken{exprString, s})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{exprNumber, src[i:j]})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] == '.' || src[j] >= 'a' && src[j] <= 'z' ||
+				src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{exprIdent, src[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, exprToken{exprOperator, op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// singleToDoubleQuoted turns the body of a single-quoted string into a double-quoted Go string
+// literal with the same escapes, so that both quote styles are unquoted alike.
+func singleToDoubleQuoted(body string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\' && i+1 < len(body) && body[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case body[i] == '\\' && i+1 < len(body):
+			b.WriteString(body[i : i+2])
+			i++
+		case body[i] == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(body[i])
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+// accept consumes the next token if it is the given operator or keyword.
+func (p *exprParser) accept(text string) bool {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind != exprString && p.tokens[p.pos].text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{"||", l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	l, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{"&&", l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	l, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			r, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			return &binaryExpr{op, l, r}, nil
+		}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAdditive() (expr, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := "+"
+		if !p.accept(op) {
+			if op = "-"; !p.accept(op) {
+				return l, nil
+			}
+		}
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = &binaryExpr{op, l, r}
+	}
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	switch {
+	case p.accept("!"):
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{x}, nil
+	case p.accept("-"):
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &negExpr{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	switch tok.kind {
+	case exprString:
+		return &literalExpr{tok.text}, nil
+	case exprNumber:
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", tok.text)
+		}
+		return &literalExpr{f}, nil
+	case exprIdent:
+		switch tok.text {
+		case "true":
+			return &literalExpr{true}, nil
+		case "false":
+			return &literalExpr{false}, nil
+		case "null":
+			return &literalExpr{nil}, nil
+		}
+		path := strings.Split(tok.text, ".")
+		if path[0] != "claims" && path[0] != "token" {
+			return nil, fmt.Errorf("unknown variable %q, expected claims or token", path[0])
+		}
+		for _, name := range path {
+			if name == "" {
+				return nil, fmt.Errorf("invalid path %q", tok.text)
+			}
+		}
+		return &pathExpr{path}, nil
+	}
+
+	switch tok.text {
+	case "(":
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("missing )")
+		}
+		return e, nil
+	case "[":
+		list := &listExpr{}
+		if p.accept("]") {
+			return list, nil
+		}
+		for {
+			item, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			list.items = append(list.items, item)
+			if p.accept("]") {
+				return list, nil
+			}
+			if !p.accept(",") {
+				return nil, fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
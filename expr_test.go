@@ -0,0 +1,134 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	token := &Token{
+		UID:      "user-1",
+		IssuedAt: 1700000000,
+		Firebase: FirebaseInfo{SignInProvider: "password"},
+		Claims: map[string]interface{}{
+			"plan":     "pro",
+			"roles":    []interface{}{"admin", "dev"},
+			"n":        float64(3),
+			"verified": true,
+			"org":      map[string]interface{}{"id": "acme"},
+		},
+	}
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		// Precedence.
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!claims.plan == false`, false},
+		{`!(claims.plan == "free")`, true},
+		{`!!claims.verified`, true},
+		{`claims.n == 1 + 2`, true},
+		{`claims.n-1 > 0`, true},
+		{`claims.n - 1 - 1 == 1`, true},
+		{`-claims.n == -3`, true},
+		{`claims.n > 2 && claims.n < 4`, true},
+
+		// Strings and escapes.
+		{`'a\nb' == "a\nb"`, true},
+		{`'it\'s' == "it's"`, true},
+		{`'say "hi"' == "say \"hi\""`, true},
+		{`"a" + 'b' == "ab"`, true},
+		{`claims.plan >= "pro" && claims.plan < "q"`, true},
+
+		// Membership.
+		{`"admin" in claims.roles`, true},
+		{`"ops" in claims.roles`, false},
+		{`claims.plan in ["free", "pro"]`, true},
+		{`claims.n in [1, 3]`, true},
+		{`-1 in [-1]`, true},
+		{`"p" in claims.plan`, false},
+		{`"admin" in claims.missing`, false},
+
+		// Paths.
+		{`claims.org.id == "acme"`, true},
+		{`token.uid == "user-1"`, true},
+		{`token.iat > 1600000000`, true},
+		{`token.firebase.sign_in_provider == "password"`, true},
+		{`token.plan == claims.plan`, true},
+		{`claims.missing == null`, true},
+		{`claims.missing.deep == null`, true},
+		{`claims.plan.deep == null`, true},
+		{`claims.missing`, false},
+		{`!claims.missing`, true},
+
+		// Type mismatches are false rather than errors.
+		{`claims.n == "3"`, false},
+		{`claims.n < "4"`, false},
+		{`claims.plan > 1`, false},
+		{`claims.roles == ["admin", "dev"]`, false},
+		{`claims.plan + 1 == null`, true},
+		{`claims.plan - "p" == null`, true},
+		{`claims.plan`, false},
+	}
+	env := expressionEnv(token)
+	for _, tt := range tests {
+		e, err := compileExpr(tt.src)
+		if err != nil {
+			t.Errorf("compileExpr(%s): %v", tt.src, err)
+			continue
+		}
+		if got := isTrue(e.eval(env)); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExprCompileErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`claims.plan ==`,
+		`(true`,
+		`true)`,
+		`user.plan == "pro"`,
+		`claims..plan`,
+		`"unterminated`,
+		`'unterminated\'`,
+		`"bad \q escape"`,
+		`claims.plan == "a" == "b"`,
+		`[1 2]`,
+		`[1,`,
+		`1.2.3`,
+		`claims.plan @ 1`,
+		`claims.plan = "pro"`,
+		`true &&`,
+	} {
+		if _, err := compileExpr(src); err == nil {
+			t.Errorf("compileExpr(%s) succeeded", src)
+		}
+	}
+}
+
+func TestPolicyExpandsEnv(t *testing.T) {
+	setenv(t, "REQUIRED_PLAN", "pro")
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.Policy = `claims.plan == "${REQUIRED_PLAN}"`
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for plan, want := range map[string]int{"pro": http.StatusOK, "free": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{"plan": plan}))
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Errorf("plan %q: status = %d, want %d", plan, rw.Code, want)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package firebase_verify_token
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gRPC status codes used for rejected calls, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md.
+const (
+	grpcPermissionDenied = 7
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// isGRPCRequest reports whether req is a gRPC or gRPC-Web call, whose clients expect the
+// outcome in grpc-status rather than in the HTTP status.
+func isGRPCRequest(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+// rejectGRPC answers a gRPC call with a trailers-only response carrying the given status. The
+// HTTP status is 200 as the gRPC protocol requires.
+func rejectGRPC(rw http.ResponseWriter, req *http.Request, code int, message string) {
+	contentType := "application/grpc"
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc-web") {
+		contentType = req.Header.Get("Content-Type")
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Grpc-Status", strconv.Itoa(code))
+	rw.Header().Set("Grpc-Message", message)
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,67 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRejectGRPC(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		token       string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"missing token", "application/grpc", "", grpcUnauthenticated, "Unauthorized"},
+		{"invalid token", "application/grpc+proto", "not-a-jwt", grpcUnauthenticated, "Unauthorized"},
+		{"blocked user", "application/grpc", mintTestToken(t, nil), grpcPermissionDenied, "Forbidden"},
+		{"gRPC-Web", "application/grpc-web+proto", "", grpcUnauthenticated, "Unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.BlockedUIDs = []string{"user-1"}
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				t.Error("request was forwarded")
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", nil)
+			req.Header.Set("Content-Type", tt.contentType)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+
+			// A trailers-only response: HTTP 200, the status in headers and no body.
+			if rw.Code != http.StatusOK {
+				t.Errorf("HTTP status = %d, want %d", rw.Code, http.StatusOK)
+			}
+			wantContentType := "application/grpc"
+			if tt.contentType == "application/grpc-web+proto" {
+				wantContentType = tt.contentType
+			}
+			if got := rw.Header().Get("Content-Type"); got != wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, wantContentType)
+			}
+			if got := rw.Header().Get("Grpc-Status"); got != strconv.Itoa(tt.wantStatus) {
+				t.Errorf("Grpc-Status = %q, want %d", got, tt.wantStatus)
+			}
+			if got := rw.Header().Get("Grpc-Message"); got != tt.wantMessage {
+				t.Errorf("Grpc-Message = %q, want %q", got, tt.wantMessage)
+			}
+			if rw.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", rw.Body.String())
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package firebase_verify_token
 
+import "time"
+
 type FirebaseInfo struct {
 	SignInProvider string                 `json:"sign_in_provider"`
 	Tenant         string                 `json:"tenant"`
@@ -7,15 +9,24 @@ type FirebaseInfo struct {
 }
 
 type Token struct {
-	AuthTime int64                  `json:"auth_time"`
-	Issuer   string                 `json:"iss"`
-	Audience string                 `json:"aud"`
-	Expires  int64                  `json:"exp"`
-	IssuedAt int64                  `json:"iat"`
-	Subject  string                 `json:"sub,omitempty"`
-	UID      string                 `json:"uid,omitempty"`
-	Firebase FirebaseInfo           `json:"firebase"`
-	Claims   map[string]interface{} `json:"-"`
+	AuthTime  int64                  `json:"auth_time"`
+	Issuer    string                 `json:"iss"`
+	Audience  string                 `json:"aud"`
+	Expires   int64                  `json:"exp"`
+	IssuedAt  int64                  `json:"iat"`
+	NotBefore int64                  `json:"nbf,omitempty"`
+	Subject   string                 `json:"sub,omitempty"`
+	UID       string                 `json:"uid,omitempty"`
+	Firebase  FirebaseInfo           `json:"firebase"`
+	Claims    map[string]interface{} `json:"-"`
+	// KeyID is the kid of the public key that verified the token signature. It is only set on
+	// verified tokens.
+	KeyID string `json:"-"`
+	// ProjectID is the configured project the token was accepted for, which differs from
+	// Audience when Config.Audiences is set. It is set once the audience and issuer checks
+	// pass, so the unverified tokens VerifyIDTokenDetailed returns with timestamp or signature
+	// errors carry it too.
+	ProjectID string `json:"-"`
 }
 
 type jwtHeader struct {
@@ -23,3 +34,71 @@ type jwtHeader struct {
 	Type      string `json:"typ"`
 	KeyID     string `json:"kid,omitempty"`
 }
+
+// TimeToExpiry returns how long the token remains valid, or zero if it has already expired.
+func (t *Token) TimeToExpiry() time.Duration {
+	remaining := time.Until(time.Unix(t.Expires, 0))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// AllClaims returns the standard claims of the token together with its custom claims, as a
+// single map. The standard claims are rebuilt from the typed fields and take precedence over
+// custom claims with the same name.
+func (t *Token) AllClaims() map[string]interface{} {
+	claims := make(map[string]interface{}, len(t.Claims)+9)
+	for key, value := range t.Claims {
+		claims[key] = value
+	}
+	claims["iss"] = t.Issuer
+	claims["aud"] = t.Audience
+	claims["sub"] = t.Subject
+	claims["uid"] = t.UID
+	claims["exp"] = t.Expires
+	claims["iat"] = t.IssuedAt
+	claims["auth_time"] = t.AuthTime
+	claims["firebase"] = t.Firebase
+	if t.NotBefore != 0 {
+		claims["nbf"] = t.NotBefore
+	}
+	return claims
+}
+
+// ClaimString returns the named custom claim if it is a string.
+func (t *Token) ClaimString(name string) (string, bool) {
+	value, ok := t.Claims[name].(string)
+	return value, ok
+}
+
+// ClaimBool returns the named custom claim if it is a boolean.
+func (t *Token) ClaimBool(name string) (bool, bool) {
+	value, ok := t.Claims[name].(bool)
+	return value, ok
+}
+
+// ClaimFloat returns the named custom claim if it is a number. JSON numbers are always decoded
+// as float64.
+func (t *Token) ClaimFloat(name string) (float64, bool) {
+	value, ok := t.Claims[name].(float64)
+	return value, ok
+}
+
+// ClaimStringSlice returns the named custom claim if it is an array whose elements are all
+// strings.
+func (t *Token) ClaimStringSlice(name string) ([]string, bool) {
+	values, ok := t.Claims[name].([]interface{})
+	if !ok {
+		return nil, false
+	}
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, str)
+	}
+	return result, true
+}
@@ -0,0 +1,102 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClaimHelpers(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+
+	// Decode a real token so the claims have the types encoding/json produces.
+	token, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, map[string]interface{}{
+		"role":   "admin",
+		"admin":  true,
+		"level":  3,
+		"scopes": []string{"read", "write"},
+		"mixed":  []interface{}{"read", 1},
+		"empty":  []string{},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ClaimString", func(t *testing.T) {
+		if v, ok := token.ClaimString("role"); !ok || v != "admin" {
+			t.Errorf("ClaimString(role) = %q, %v", v, ok)
+		}
+		if _, ok := token.ClaimString("missing"); ok {
+			t.Error("ClaimString(missing) reported a value")
+		}
+		if _, ok := token.ClaimString("level"); ok {
+			t.Error("ClaimString(level) accepted a number")
+		}
+	})
+
+	t.Run("ClaimBool", func(t *testing.T) {
+		if v, ok := token.ClaimBool("admin"); !ok || !v {
+			t.Errorf("ClaimBool(admin) = %v, %v", v, ok)
+		}
+		if _, ok := token.ClaimBool("missing"); ok {
+			t.Error("ClaimBool(missing) reported a value")
+		}
+		if _, ok := token.ClaimBool("role"); ok {
+			t.Error("ClaimBool(role) accepted a string")
+		}
+	})
+
+	t.Run("ClaimFloat", func(t *testing.T) {
+		if v, ok := token.ClaimFloat("level"); !ok || v != 3 {
+			t.Errorf("ClaimFloat(level) = %v, %v", v, ok)
+		}
+		if _, ok := token.ClaimFloat("missing"); ok {
+			t.Error("ClaimFloat(missing) reported a value")
+		}
+		if _, ok := token.ClaimFloat("admin"); ok {
+			t.Error("ClaimFloat(admin) accepted a boolean")
+		}
+	})
+
+	t.Run("ClaimStringSlice", func(t *testing.T) {
+		if v, ok := token.ClaimStringSlice("scopes"); !ok || !reflect.DeepEqual(v, []string{"read", "write"}) {
+			t.Errorf("ClaimStringSlice(scopes) = %v, %v", v, ok)
+		}
+		if v, ok := token.ClaimStringSlice("empty"); !ok || len(v) != 0 {
+			t.Errorf("ClaimStringSlice(empty) = %v, %v", v, ok)
+		}
+		if _, ok := token.ClaimStringSlice("missing"); ok {
+			t.Error("ClaimStringSlice(missing) reported a value")
+		}
+		if _, ok := token.ClaimStringSlice("role"); ok {
+			t.Error("ClaimStringSlice(role) accepted a string")
+		}
+		if _, ok := token.ClaimStringSlice("mixed"); ok {
+			t.Error("ClaimStringSlice(mixed) accepted a non-string element")
+		}
+	})
+}
+
+func TestTimeToExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		expires int64
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"an hour left", now.Add(time.Hour).Unix(), 59 * time.Minute, time.Hour},
+		{"nearly expired", now.Add(2 * time.Second).Unix(), 0, 2 * time.Second},
+		{"expired", now.Add(-time.Minute).Unix(), 0, 0},
+	}
+	for _, tt := range tests {
+		token := &Token{Expires: tt.expires}
+		if got := token.TimeToExpiry(); got < tt.min || got > tt.max {
+			t.Errorf("%s: TimeToExpiry() = %v, want between %v and %v", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
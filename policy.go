@@ -0,0 +1,261 @@
+package firebase_verify_token
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Policy adds claim requirements to the requests matching a path pattern and, optionally, a
+// set of methods.
+type Policy struct {
+	// Path is matched against the cleaned request path. A trailing "*" matches any suffix,
+	// and "/admin/*" matches "/admin" itself too; otherwise the pattern follows path.Match
+	// syntax. Matching is case-sensitive, like Traefik's Path rules, so "/Admin/x" does not
+	// match "/admin/*".
+	Path string `json:"Path"`
+	// Methods restricts the policy to the given HTTP methods. Empty means all methods.
+	Methods []string `json:"Methods,omitempty"`
+	// RequiredClaims lists the custom claims the token must carry. Scalar claims must be equal
+	// to the given value, array claims must contain it.
+	RequiredClaims map[string]interface{} `json:"RequiredClaims,omitempty"`
+	// Groups, if set, requires the token to belong to at least one of the named groups, see
+	// GroupMapping.
+	Groups []string `json:"Groups,omitempty"`
+	// Public forwards matching requests that carry no token without verification, e.g. for
+	// the GET routes of an API whose writes require a token. Tokens that are present are still
+	// verified.
+	Public bool `json:"Public,omitempty"`
+}
+
+// GroupMapping puts the users whose token has a given claim value into a named group, e.g.
+// plan=enterprise into "premium". Array claims match when they contain the value.
+type GroupMapping struct {
+	Group string      `json:"Group"`
+	Claim string      `json:"Claim"`
+	Value interface{} `json:"Value"`
+}
+
+// authorizationError is returned for requests carrying a valid token that is not allowed to
+// access the requested resource.
+type authorizationError struct {
+	reason string
+}
+
+func (e *authorizationError) Error() string {
+	return e.reason
+}
+
+func validatePolicies(policies []Policy, groups []GroupMapping) error {
+	known := make(map[string]bool, len(groups))
+	for i, g := range groups {
+		if g.Group == "" || g.Claim == "" {
+			return fmt.Errorf("configuration incorrect, group mapping %d needs a Group and a Claim", i)
+		}
+		known[g.Group] = true
+	}
+	for i, p := range policies {
+		for _, group := range p.Groups {
+			if !known[group] {
+				return fmt.Errorf("configuration incorrect, policy %d references unknown group %q", i, group)
+			}
+		}
+		if p.Path == "" {
+			return fmt.Errorf("configuration incorrect, policy %d has no Path", i)
+		}
+		if _, err := path.Match(strings.TrimSuffix(p.Path, "*"), ""); err != nil {
+			return fmt.Errorf("configuration incorrect, policy %d has invalid Path %q: %v", i, p.Path, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the policy applies to the given request.
+func (p *Policy) matches(req *http.Request) bool {
+	if len(p.Methods) > 0 {
+		found := false
+		for _, method := range p.Methods {
+			if strings.EqualFold(method, req.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	// Match on the canonical path, so that "//admin/x" or "/public/../admin/x" cannot be used
+	// to escape the policies for "/admin/x".
+	requestPath := cleanPath(req.URL.Path)
+	if strings.HasSuffix(p.Path, "*") {
+		prefix := strings.TrimSuffix(p.Path, "*")
+		// "/admin/*" guards "/admin" too, which most upstreams serve like "/admin/".
+		return strings.HasPrefix(requestPath, prefix) ||
+			strings.HasSuffix(prefix, "/") && requestPath == strings.TrimSuffix(prefix, "/")
+	}
+	matched, _ := path.Match(p.Path, requestPath)
+	return matched
+}
+
+// cleanPath returns the canonical form of a request path: rooted, with duplicate slashes and
+// "." and ".." elements resolved. A trailing slash is kept.
+func cleanPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// matchingPolicy returns the first policy matching the request, or nil.
+func matchingPolicy(policies []Policy, req *http.Request) *Policy {
+	for i := range policies {
+		if policies[i].matches(req) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+// evaluatePolicies applies the first policy matching the request to the token. Requests that
+// match no policy only need a valid token.
+func evaluatePolicies(policies []Policy, req *http.Request, token *Token, groups []string) error {
+	p := matchingPolicy(policies, req)
+	if p == nil {
+		return nil
+	}
+	if len(p.Groups) > 0 {
+		member := false
+		for _, group := range p.Groups {
+			if containsString(groups, group) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return &authorizationError{fmt.Sprintf("user is in none of the groups %q", p.Groups)}
+		}
+	}
+	return checkRequiredClaims(p.RequiredClaims, token)
+}
+
+// resolveGroups returns the groups the token belongs to, in mapping order and without
+// duplicates.
+func resolveGroups(mappings []GroupMapping, token *Token) []string {
+	var groups []string
+	for _, m := range mappings {
+		if !containsString(groups, m.Group) && claimMatches(token.Claims[m.Claim], m.Value) {
+			groups = append(groups, m.Group)
+		}
+	}
+	return groups
+}
+
+// checkIdentity applies the restrictions on who may use the middleware to a verified token.
+func (st *settings) checkIdentity(token *Token) error {
+	if st.denyAnonymous && token.Firebase.SignInProvider == "anonymous" {
+		return &authorizationError{"anonymous users are not allowed"}
+	}
+	if st.verifiedEmailOnly {
+		if verified, _ := token.Claims["email_verified"].(bool); !verified {
+			return &authorizationError{"email address is not verified"}
+		}
+	}
+	if len(st.allowedProviders) > 0 && !containsString(st.allowedProviders, token.Firebase.SignInProvider) {
+		return &authorizationError{fmt.Sprintf("sign-in provider %q is not allowed", token.Firebase.SignInProvider)}
+	}
+	if len(st.allowedTenants) > 0 && !containsString(st.allowedTenants, token.Firebase.Tenant) {
+		return &authorizationError{fmt.Sprintf("tenant %q is not allowed", token.Firebase.Tenant)}
+	}
+	if matchesAny(st.blockedUIDs, token.UID) {
+		return &authorizationError{fmt.Sprintf("user %q is blocked", token.UID)}
+	}
+	if len(st.allowedUIDs) > 0 && !matchesAny(st.allowedUIDs, token.UID) {
+		return &authorizationError{fmt.Sprintf("user %q is not allowed", token.UID)}
+	}
+	return nil
+}
+
+// matchesAny reports whether s matches one of the path.Match patterns.
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, s); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRequiredClaims(required map[string]interface{}, token *Token) error {
+	for name, expected := range required {
+		if !claimMatches(token.Claims[name], expected) {
+			return &authorizationError{fmt.Sprintf("claim %q does not match the required value", name)}
+		}
+	}
+	return nil
+}
+
+// matchRoles returns the roles held in the named claim of the token, restricted to allowed
+// when it is non-empty. A token holding none of the allowed roles is not authorized.
+func matchRoles(token *Token, claim string, allowed []string) ([]string, error) {
+	var held []string
+	switch value := token.Claims[claim].(type) {
+	case string:
+		held = []string{value}
+	case []interface{}:
+		for _, v := range value {
+			if role, ok := v.(string); ok {
+				held = append(held, role)
+			}
+		}
+	}
+	if len(allowed) == 0 {
+		return held, nil
+	}
+
+	var matched []string
+	for _, role := range held {
+		for _, a := range allowed {
+			if role == a {
+				matched = append(matched, role)
+				break
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return nil, &authorizationError{fmt.Sprintf("claim %q holds none of the allowed roles", claim)}
+	}
+	return matched, nil
+}
+
+// claimMatches compares a claim value with an expected value by their string forms, since
+// values from the Traefik configuration are usually strings. Array claims match when any of
+// their elements does.
+func claimMatches(actual, expected interface{}) bool {
+	if actual == nil {
+		return false
+	}
+	if values, ok := actual.([]interface{}); ok {
+		for _, value := range values {
+			if claimMatches(value, expected) {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprint(actual) == fmt.Sprint(expected)
+}
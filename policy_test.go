@@ -0,0 +1,235 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/admin/x", "/admin/x"},
+		{"//admin/x", "/admin/x"},
+		{"/public/../admin/x", "/admin/x"},
+		{"/public/./x", "/public/x"},
+		{"/../../admin", "/admin"},
+		{"admin", "/admin"},
+		{"/admin/", "/admin/"},
+		{"/admin//", "/admin/"},
+	}
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyMatches(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		method string
+		path   string
+		want   bool
+	}{
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/admin/x", true},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/admin/", true},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/admin", true},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/admin/.", true},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/administrator", false},
+		{Policy{Path: "/admin*"}, http.MethodGet, "/administrator", true},
+		{Policy{Path: "/*"}, http.MethodGet, "/", true},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/Admin/x", false},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/ADMIN", false},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "//admin/x", true},
+		{Policy{Path: "/admin/*"}, http.MethodGet, "/public/../admin/x", true},
+		{Policy{Path: "/public/*"}, http.MethodGet, "/public/../admin/x", false},
+		{Policy{Path: "/users/?"}, http.MethodGet, "/users/1", true},
+		{Policy{Path: "/users/?"}, http.MethodGet, "/users/12", false},
+		{Policy{Path: "/users/?"}, http.MethodGet, "/users/./1", true},
+		{Policy{Path: "/admin/*", Methods: []string{"POST"}}, http.MethodPost, "/admin/x", true},
+		{Policy{Path: "/admin/*", Methods: []string{"post"}}, http.MethodPost, "/admin/x", true},
+		{Policy{Path: "/admin/*", Methods: []string{"POST"}}, http.MethodGet, "/admin/x", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		req.URL.Path = tt.path
+		if got := tt.policy.matches(req); got != tt.want {
+			t.Errorf("%+v matches %s %s = %v, want %v", tt.policy, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePolicies(t *testing.T) {
+	groups := []GroupMapping{{Group: "staff", Claim: "role", Value: "staff"}}
+	tests := []struct {
+		name     string
+		policies []Policy
+		wantErr  bool
+	}{
+		{"valid", []Policy{{Path: "/admin/*", Groups: []string{"staff"}}}, false},
+		{"no path", []Policy{{Methods: []string{"GET"}}}, true},
+		{"bad pattern", []Policy{{Path: "/admin/["}}, true},
+		{"unknown group", []Policy{{Path: "/admin/*", Groups: []string{"admins"}}}, true},
+	}
+	for _, tt := range tests {
+		if err := validatePolicies(tt.policies, groups); (err != nil) != tt.wantErr {
+			t.Errorf("%s: validatePolicies() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPublicPolicyPathTraversal(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.Policies = []Policy{{Path: "/public/*", Public: true}}
+	var forwarded bool
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded = true
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/public/x", http.StatusOK},
+		{"/public/./x", http.StatusOK},
+		{"/public/../admin/x", http.StatusUnauthorized},
+		{"/public/../../admin/x", http.StatusUnauthorized},
+		{"//admin/x", http.StatusUnauthorized},
+		{"/public/..", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			forwarded = false
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.URL.Path = tt.path
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("status = %d, want %d", rw.Code, tt.want)
+			}
+			if wantForwarded := tt.want == http.StatusOK; forwarded != wantForwarded {
+				t.Errorf("forwarded = %v, want %v", forwarded, wantForwarded)
+			}
+		})
+	}
+}
+
+func TestIdentityRestrictions(t *testing.T) {
+	anonymous := map[string]interface{}{"firebase": map[string]interface{}{"sign_in_provider": "anonymous"}}
+	google := map[string]interface{}{"firebase": map[string]interface{}{"sign_in_provider": "google.com"}}
+	tenant := map[string]interface{}{"firebase": map[string]interface{}{"sign_in_provider": "password", "tenant": "tenant-a"}}
+	admin := map[string]interface{}{"sub": "admin-7"}
+	tests := []struct {
+		name   string
+		config func(*Config)
+		claims map[string]interface{}
+		want   int
+	}{
+		{"anonymous allowed by default", func(*Config) {}, anonymous, http.StatusOK},
+		{"anonymous denied", func(cfg *Config) { cfg.DenyAnonymousUsers = true }, anonymous, http.StatusForbidden},
+		{"password user with anonymous denied", func(cfg *Config) { cfg.DenyAnonymousUsers = true }, nil, http.StatusOK},
+		{"allowed provider", func(cfg *Config) { cfg.AllowedProviders = []string{"google.com"} }, google, http.StatusOK},
+		{"other provider", func(cfg *Config) { cfg.AllowedProviders = []string{"google.com"} }, nil, http.StatusForbidden},
+		{"allowed tenant", func(cfg *Config) { cfg.AllowedTenants = []string{"tenant-a"} }, tenant, http.StatusOK},
+		{"other tenant", func(cfg *Config) { cfg.AllowedTenants = []string{"tenant-b"} }, tenant, http.StatusForbidden},
+		{"no tenant", func(cfg *Config) { cfg.AllowedTenants = []string{"tenant-a"} }, nil, http.StatusForbidden},
+		{"allowed uid", func(cfg *Config) { cfg.AllowedUIDs = []string{"user-1"} }, nil, http.StatusOK},
+		{"allowed uid pattern", func(cfg *Config) { cfg.AllowedUIDs = []string{"admin-*"} }, admin, http.StatusOK},
+		{"uid not allowed", func(cfg *Config) { cfg.AllowedUIDs = []string{"admin-*"} }, nil, http.StatusForbidden},
+		{"blocked uid", func(cfg *Config) { cfg.BlockedUIDs = []string{"user-1"} }, nil, http.StatusForbidden},
+		{"blocked uid pattern", func(cfg *Config) { cfg.BlockedUIDs = []string{"admin-?"} }, admin, http.StatusForbidden},
+		{"uid not blocked", func(cfg *Config) { cfg.BlockedUIDs = []string{"admin-*"} }, nil, http.StatusOK},
+		{"blocked wins over allowed", func(cfg *Config) {
+			cfg.AllowedUIDs = []string{"user-*"}
+			cfg.BlockedUIDs = []string{"user-1"}
+		}, nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			tt.config(cfg)
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, tt.claims))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("status = %d, want %d", rw.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.Policies = []Policy{
+		{Path: "/admin/*", Methods: []string{"POST"}, RequiredClaims: map[string]interface{}{"role": "admin"}},
+		{Path: "/admin/*", RequiredClaims: map[string]interface{}{"role": "staff"}},
+		{Path: "/reports/*", RequiredClaims: map[string]interface{}{"scopes": "reports"}},
+	}
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := mintTestToken(t, map[string]interface{}{"role": "admin"})
+	staff := mintTestToken(t, map[string]interface{}{"role": "staff"})
+	user := mintTestToken(t, nil)
+	reporter := mintTestToken(t, map[string]interface{}{"scopes": []string{"read", "reports"}})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"admin writes", http.MethodPost, "/admin/x", admin, http.StatusOK},
+		{"staff cannot write", http.MethodPost, "/admin/x", staff, http.StatusForbidden},
+		{"first matching policy wins", http.MethodGet, "/admin/x", admin, http.StatusForbidden},
+		{"staff reads", http.MethodGet, "/admin/x", staff, http.StatusOK},
+		{"user cannot read", http.MethodGet, "/admin/x", user, http.StatusForbidden},
+		{"unmatched route needs a valid token", http.MethodGet, "/other", user, http.StatusOK},
+		{"unmatched route without a token", http.MethodGet, "/other", "", http.StatusUnauthorized},
+		{"array claim contains value", http.MethodGet, "/reports/1", reporter, http.StatusOK},
+		{"double slash", http.MethodGet, "//admin/x", user, http.StatusForbidden},
+		{"dot segments", http.MethodGet, "/public/../admin/x", user, http.StatusForbidden},
+		{"dot segments on write", http.MethodPost, "/other/../admin/x", staff, http.StatusForbidden},
+		{"prefix without trailing slash", http.MethodGet, "/admin", user, http.StatusForbidden},
+		{"prefix without trailing slash, allowed", http.MethodGet, "/admin", staff, http.StatusOK},
+		{"matching is case-sensitive", http.MethodGet, "/Admin/x", user, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.URL.Path = tt.path
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("status = %d, want %d", rw.Code, tt.want)
+			}
+		})
+	}
+}
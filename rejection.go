@@ -0,0 +1,246 @@
+package firebase_verify_token
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// Stable error codes describing why a request was rejected, sent in JSON error bodies.
+const (
+	errorCodeMissingToken     = "missing_token"
+	errorCodeTokenExpired     = "token_expired"
+	errorCodeBadSignature     = "bad_signature"
+	errorCodeKeysUnavailable  = "keys_unavailable"
+	errorCodeInvalidToken     = "invalid_token"
+	errorCodeClaimDenied      = "claim_denied"
+	errorCodeAuthzUnavailable = "authz_unavailable"
+)
+
+// errorMessages holds the client-facing message of each error code. They are kept generic so
+// they do not reveal how the token was checked.
+var errorMessages = map[string]string{
+	errorCodeMissingToken:     "No token was provided",
+	errorCodeTokenExpired:     "The token has expired",
+	errorCodeBadSignature:     "The token signature is invalid",
+	errorCodeKeysUnavailable:  "The token could not be verified, try again later",
+	errorCodeInvalidToken:     "The token is malformed or invalid",
+	errorCodeClaimDenied:      "The token does not grant access to this resource",
+	errorCodeAuthzUnavailable: "Access could not be checked, try again later",
+}
+
+// errorCode classifies the error a request was rejected with.
+func errorCode(err error) string {
+	var authzErr *authorizationError
+	var unavailableErr *authzUnavailableError
+	switch {
+	case errors.Is(err, errTokenNotFound):
+		return errorCodeMissingToken
+	case errors.As(err, &authzErr):
+		return errorCodeClaimDenied
+	case errors.As(err, &unavailableErr):
+		return errorCodeAuthzUnavailable
+	case isTokenExpired(err):
+		return errorCodeTokenExpired
+	case errors.Is(err, errBadSignature):
+		return errorCodeBadSignature
+	case isKeySourceError(err):
+		return errorCodeKeysUnavailable
+	}
+	return errorCodeInvalidToken
+}
+
+// bearerChallenge returns the WWW-Authenticate value of RFC 6750 for a rejection with the
+// given error code. A request without any token gets a bare challenge, as section 3.1
+// recommends.
+func bearerChallenge(realm, code string) string {
+	var params []string
+	if realm != "" {
+		params = append(params, "realm="+quoteAuthParam(realm))
+	}
+	switch code {
+	case errorCodeMissingToken:
+	case errorCodeClaimDenied:
+		params = append(params, `error="insufficient_scope"`, "error_description="+quoteAuthParam(errorMessages[code]))
+	default:
+		params = append(params, `error="invalid_token"`, "error_description="+quoteAuthParam(errorMessages[code]))
+	}
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// quoteAuthParam formats value as an RFC 7235 quoted-string.
+func quoteAuthParam(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// writeJSONError writes {"error": code, "message": ...} with the given status.
+func writeJSONError(rw http.ResponseWriter, status int, code string) {
+	body, _ := json.Marshal(map[string]string{"error": code, "message": errorMessages[code]})
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	rw.Write(append(body, '\n'))
+}
+
+// Rejection classes that Config.ErrorTemplates can customize.
+const (
+	rejectionMissingToken = "missingToken"
+	rejectionInvalidToken = "invalidToken"
+	rejectionForbidden    = "forbidden"
+)
+
+const defaultErrorContentType = "text/html; charset=utf-8"
+
+// ErrorTemplate is the response body of a rejection class. Body is a Go template that can use
+// {{.Status}}, {{.Code}}, {{.Message}}, {{.Method}} and {{.Path}}; it is parsed with
+// html/template, which escapes the request path, when ContentType is HTML, and with
+// text/template otherwise.
+type ErrorTemplate struct {
+	// ContentType defaults to "text/html; charset=utf-8".
+	ContentType string `json:"ContentType,omitempty"`
+	Body        string `json:"Body"`
+}
+
+// errorTemplateData is the data ErrorTemplate bodies are executed with.
+type errorTemplateData struct {
+	Status  int
+	Code    string
+	Message string
+	Method  string
+	Path    string
+}
+
+type errorTemplate struct {
+	contentType string
+	body        interface {
+		Execute(w io.Writer, data interface{}) error
+	}
+}
+
+// rejectionClass maps an error code to the rejection class whose template renders it.
+func rejectionClass(code string) string {
+	switch code {
+	case errorCodeMissingToken:
+		return rejectionMissingToken
+	case errorCodeClaimDenied:
+		return rejectionForbidden
+	}
+	return rejectionInvalidToken
+}
+
+// parseErrorTemplates parses the templates of Config.ErrorTemplates by rejection class.
+func parseErrorTemplates(templates map[string]ErrorTemplate) (map[string]*errorTemplate, error) {
+	parsed := make(map[string]*errorTemplate, len(templates))
+	for class, t := range templates {
+		switch class {
+		case rejectionMissingToken, rejectionInvalidToken, rejectionForbidden:
+		default:
+			return nil, fmt.Errorf("configuration incorrect, ErrorTemplates keys must be %q, %q or %q but got %q",
+				rejectionMissingToken, rejectionInvalidToken, rejectionForbidden, class)
+		}
+		et := &errorTemplate{contentType: t.ContentType}
+		if et.contentType == "" {
+			et.contentType = defaultErrorContentType
+		}
+		if !isValidHeaderValue(et.contentType) {
+			return nil, fmt.Errorf("configuration incorrect, invalid ErrorTemplates[%q] content type %q", class, et.contentType)
+		}
+		var err error
+		if strings.Contains(et.contentType, "html") {
+			et.body, err = htmltemplate.New(class).Parse(t.Body)
+		} else {
+			et.body, err = template.New(class).Parse(t.Body)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("configuration incorrect, invalid ErrorTemplates[%q]: %v", class, err)
+		}
+		parsed[class] = et
+	}
+	return parsed, nil
+}
+
+// write renders t with the given status. Nothing is written when the template fails to
+// execute, so that the default response can be sent instead.
+func (t *errorTemplate) write(rw http.ResponseWriter, req *http.Request, status int, code string) error {
+	var body bytes.Buffer
+	data := errorTemplateData{Status: status, Code: code, Message: errorMessages[code], Method: req.Method, Path: req.URL.Path}
+	if err := t.body.Execute(&body, data); err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", t.contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	rw.Write(body.Bytes())
+	return nil
+}
+
+// prefersHTML reports whether req is a browser navigation: a GET or HEAD request whose Accept
+// header ranks text/html explicitly and at least as high as application/json.
+func prefersHTML(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	var htmlQ, jsonQ float64
+	for _, accept := range req.Header.Values("Accept") {
+		for _, item := range strings.Split(accept, ",") {
+			parts := strings.Split(item, ";")
+			q := 1.0
+			for _, param := range parts[1:] {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "q") {
+					if f, err := strconv.ParseFloat(kv[1], 64); err == nil {
+						q = f
+					}
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(parts[0])) {
+			case "text/html", "application/xhtml+xml":
+				if q > htmlQ {
+					htmlQ = q
+				}
+			case "application/json":
+				if q > jsonQ {
+					jsonQ = q
+				}
+			}
+		}
+	}
+	return htmlQ > 0 && htmlQ >= jsonQ
+}
+
+// loginRedirect returns the RedirectURL a browser is sent to, with the URL of the rejected
+// request added as the query parameter param when that is set.
+func loginRedirect(redirectURL, param string, req *http.Request) string {
+	if param == "" {
+		return redirectURL
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	original := scheme + "://" + req.Host + req.URL.RequestURI()
+
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return redirectURL
+	}
+	query := u.Query()
+	query.Set(param, original)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
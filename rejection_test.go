@@ -0,0 +1,226 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReject(t *testing.T) {
+	now := time.Now().Unix()
+	expired := mintTestToken(t, map[string]interface{}{"iat": now - 7200, "exp": now - 3600, "auth_time": now - 7200})
+	bearer := func(token string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	browser := func(req *http.Request) {
+		req.Host = "app.example.com"
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	}
+	templates := map[string]ErrorTemplate{
+		rejectionMissingToken: {Body: `<p>{{.Status}} {{.Code}} {{.Path}}</p>`},
+		rejectionForbidden:    {ContentType: "text/plain", Body: `denied: {{.Message}}`},
+	}
+	tests := []struct {
+		name        string
+		config      func(*Config)
+		request     func(*http.Request)
+		wantStatus  int
+		wantHeaders map[string]string
+		wantBody    string
+	}{
+		{"plain text", func(*Config) {}, func(*http.Request) {}, http.StatusUnauthorized, map[string]string{
+			"WWW-Authenticate": "Bearer",
+			tokenExpiredHeader: "",
+		}, "Unauthorized\n"},
+		{"JSON missing token", func(cfg *Config) { cfg.JSONErrors = true }, func(*http.Request) {}, http.StatusUnauthorized, map[string]string{
+			"Content-Type":           "application/json",
+			"X-Content-Type-Options": "nosniff",
+		}, `{"error":"missing_token","message":"No token was provided"}` + "\n"},
+		{"JSON invalid token", func(cfg *Config) { cfg.JSONErrors = true }, bearer("not-a-jwt"), http.StatusUnauthorized, map[string]string{
+			"Content-Type":     "application/json",
+			"WWW-Authenticate": `Bearer error="invalid_token", error_description="The token is malformed or invalid"`,
+		}, `{"error":"invalid_token","message":"The token is malformed or invalid"}` + "\n"},
+		{"JSON forbidden", func(cfg *Config) {
+			cfg.JSONErrors = true
+			cfg.BlockedUIDs = []string{"user-1"}
+		}, bearer(mintTestToken(t, nil)), http.StatusForbidden, map[string]string{
+			"Content-Type": "application/json",
+		}, `{"error":"claim_denied","message":"The token does not grant access to this resource"}` + "\n"},
+		{"token expired", func(cfg *Config) { cfg.JSONErrors = true }, bearer(expired), http.StatusUnauthorized, map[string]string{
+			tokenExpiredHeader: "true",
+			"WWW-Authenticate": `Bearer error="invalid_token", error_description="The token has expired"`,
+		}, `{"error":"token_expired","message":"The token has expired"}` + "\n"},
+		{"HTML template", func(cfg *Config) {
+			cfg.JSONErrors = true
+			cfg.ErrorTemplates = templates
+		}, func(req *http.Request) { req.URL.Path = "/<b>" }, http.StatusUnauthorized, map[string]string{
+			"Content-Type":           defaultErrorContentType,
+			"X-Content-Type-Options": "nosniff",
+		}, `<p>401 missing_token /&lt;b&gt;</p>`},
+		{"text template", func(cfg *Config) {
+			cfg.ErrorTemplates = templates
+			cfg.BlockedUIDs = []string{"user-1"}
+		}, bearer(mintTestToken(t, nil)), http.StatusForbidden, map[string]string{
+			"Content-Type": "text/plain",
+		}, "denied: The token does not grant access to this resource"},
+		{"no template for the class", func(cfg *Config) {
+			cfg.JSONErrors = true
+			cfg.ErrorTemplates = templates
+		}, bearer("not-a-jwt"), http.StatusUnauthorized, map[string]string{
+			"Content-Type": "application/json",
+		}, `{"error":"invalid_token","message":"The token is malformed or invalid"}` + "\n"},
+		{"redirect", func(cfg *Config) {
+			cfg.RedirectURL = "https://login.example.com/signin"
+		}, browser, http.StatusFound, map[string]string{
+			"Location": "https://login.example.com/signin",
+		}, ""},
+		{"redirect with the original URL", func(cfg *Config) {
+			cfg.RedirectURL = "https://login.example.com/signin?app=1"
+			cfg.RedirectParam = "continue"
+		}, func(req *http.Request) {
+			browser(req)
+			req.URL.RawQuery = "tab=2"
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}, http.StatusFound, map[string]string{
+			"Location": "https://login.example.com/signin?app=1&continue=https%3A%2F%2Fapp.example.com%2Fpage%3Ftab%3D2",
+		}, ""},
+		{"no redirect for API clients", func(cfg *Config) {
+			cfg.RedirectURL = "https://login.example.com/signin"
+		}, func(req *http.Request) { req.Header.Set("Accept", "application/json") }, http.StatusUnauthorized, map[string]string{
+			"Location": "",
+		}, "Unauthorized\n"},
+		{"no redirect when forbidden", func(cfg *Config) {
+			cfg.RedirectURL = "https://login.example.com/signin"
+			cfg.BlockedUIDs = []string{"user-1"}
+		}, func(req *http.Request) {
+			browser(req)
+			bearer(mintTestToken(t, nil))(req)
+		}, http.StatusForbidden, map[string]string{
+			"Location": "",
+		}, "Forbidden\n"},
+		{"UnauthorizedStatus", func(cfg *Config) { cfg.UnauthorizedStatus = http.StatusNotFound }, func(*http.Request) {}, http.StatusNotFound, map[string]string{
+			"WWW-Authenticate": "",
+		}, "Not Found\n"},
+		{"ForbiddenStatus", func(cfg *Config) {
+			cfg.ForbiddenStatus = http.StatusNotFound
+			cfg.BlockedUIDs = []string{"user-1"}
+		}, bearer(mintTestToken(t, nil)), http.StatusNotFound, map[string]string{
+			"WWW-Authenticate": "",
+		}, "Not Found\n"},
+		{"ForbiddenStatus leaves 401 alone", func(cfg *Config) { cfg.ForbiddenStatus = http.StatusNotFound }, func(*http.Request) {}, http.StatusUnauthorized, nil, "Unauthorized\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			tt.config(cfg)
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				t.Error("request was forwarded")
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/page", nil)
+			tt.request(req)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rw.Code, tt.wantStatus)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := rw.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if tt.wantStatus == http.StatusFound {
+				if !strings.Contains(rw.Body.String(), "Found") {
+					t.Errorf("body = %q, want a redirect page", rw.Body.String())
+				}
+			} else if got := rw.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		debug      bool
+		tokenTypes []string
+		request    func(*http.Request)
+		wantReason string
+		wantSource string
+		wantCache  string
+	}{
+		{"off by default", false, nil, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer not-a-jwt")
+		}, "", "", ""},
+		{"missing token", true, nil, func(*http.Request) {}, errTokenNotFound.Error(), "none", "idToken static"},
+		{"invalid header token", true, nil, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer not-a-jwt")
+		}, "*", tokenSourceHeader, "idToken static"},
+		{"blocked user", true, nil, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+		}, "*", tokenSourceHeader, "idToken static"},
+		{"session cookies", true, []string{tokenTypeIDToken, tokenTypeSessionCookie}, func(req *http.Request) {
+			req.AddCookie(&http.Cookie{Name: "session", Value: "not-a-jwt"})
+		}, "*", tokenSourceCookie, "idToken static, sessionCookie "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.Debug = tt.debug
+			cfg.BlockedUIDs = []string{"user-1"}
+			if tt.tokenTypes != nil {
+				cfg.TokenTypes = tt.tokenTypes
+				cfg.CookieName = "session"
+			}
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				t.Error("request was forwarded")
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.request(req)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusUnauthorized && rw.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want a rejection", rw.Code)
+			}
+
+			reason := rw.Header().Get(debugReasonHeader)
+			switch tt.wantReason {
+			case "":
+				if reason != "" {
+					t.Errorf("%s = %q, want none", debugReasonHeader, reason)
+				}
+			case "*":
+				if reason == "" {
+					t.Errorf("%s is missing", debugReasonHeader)
+				}
+			default:
+				if reason != tt.wantReason {
+					t.Errorf("%s = %q, want %q", debugReasonHeader, reason, tt.wantReason)
+				}
+			}
+			if source := rw.Header().Get(debugSourceHeader); source != tt.wantSource {
+				t.Errorf("%s = %q, want %q", debugSourceHeader, source, tt.wantSource)
+			}
+			if cache := rw.Header().Get(debugKeyCacheHeader); !strings.HasPrefix(cache, tt.wantCache) || (tt.wantCache == "") != (cache == "") {
+				t.Errorf("%s = %q, want %q", debugKeyCacheHeader, cache, tt.wantCache)
+			}
+		})
+	}
+}
@@ -0,0 +1,760 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// settings is the validated form of a Config. A plugin swaps its settings as a whole on Reload,
+// so a request always sees a consistent snapshot.
+type settings struct {
+	name                string
+	proxyURL            string
+	dryRun              bool
+	failOpen            bool
+	uidHeader           string
+	claimPrefix         string
+	headerName          string
+	authSchemes         []string
+	multipleAuthHeaders bool
+	basicAuth           bool
+	cookieName          string
+	queryParam          string
+	stripQueryParam     bool
+	formField           string
+	webSocketProtocol   string
+	tokenSources        []string
+	tokenSourceHeader   string
+	stripToken          bool
+	forwardExpiry       bool
+	keyIDHeader         string
+	projectIDHeader     string
+	tokenJSONHeader     string
+	authMethodHeader    string
+	skipOptions         bool
+	allowPreflight      bool
+	optional            bool
+	debug               bool
+	externalKeyIDHeader string
+	inboundHeaders      []string
+	verifier            *tokenVerifier
+	cookieVerifier      *tokenVerifier
+	tokenTypes          []string
+	signer              *tokenSigner
+	signerHeader        string
+	maxClaims           int
+	maxClaimBytes       int
+	claimOverflow       string
+	claimsAsJSON        bool
+	forwardClaims       []string
+	claimHeaderMap      map[string]string
+	claimEncoding       string
+	claimEncodings      map[string]string
+	forwardFirebase     bool
+	forwardTokenHeader  string
+	oauth2ProxyHeaders  bool
+	denyAnonymous       bool
+	verifiedEmailOnly   bool
+	allowedProviders    []string
+	allowedUIDs         []string
+	blockedUIDs         []string
+	allowedTenants      []string
+	requiredClaims      map[string]interface{}
+	policy              expr
+	policies            []Policy
+	groups              []GroupMapping
+	authz               *authzClient
+	rolesClaim          string
+	allowedRoles        []string
+	onDecision          func(DecisionEvent)
+	onUnauthorized      func(http.ResponseWriter, *http.Request, error)
+	unauthorizedStatus  int
+	forbiddenStatus     int
+	realm               string
+	jsonErrors          bool
+	errorTemplates      map[string]*errorTemplate
+	redirectURL         string
+	redirectParam       string
+}
+
+// Validate checks the configuration without contacting Google and reports every problem found
+// at once, so a broken configuration fails at startup rather than on the first request. New
+// and Reload call it before building anything. ${NAME} placeholders are expanded first.
+func (config *Config) Validate() error {
+	expanded, err := config.expandEnv()
+	if err != nil {
+		return err
+	}
+	return expanded.validate()
+}
+
+func (config *Config) validate() error {
+	var problems []error
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	projectID := resolveProjectID(config)
+	if projectID == "" {
+		check(fmt.Errorf("configuration incorrect, missing ProjectID"))
+	} else if !isValidProjectID(projectID) {
+		check(fmt.Errorf("configuration incorrect, %q is not a valid project id", projectID))
+	}
+	for _, id := range config.ProjectIDs {
+		if id = strings.TrimSpace(id); id == "" {
+			check(fmt.Errorf("configuration incorrect, ProjectIDs must not contain empty entries"))
+		} else if !isValidProjectID(id) {
+			check(fmt.Errorf("configuration incorrect, %q is not a valid project id", id))
+		}
+	}
+
+	_, err := parseEnforceMode(config.EnforceMode)
+	check(err)
+	_, err = parseClaimOverflow(config.ClaimOverflow)
+	check(err)
+	if config.HeaderProfile != "" && config.HeaderProfile != headerProfileOAuth2Proxy {
+		check(fmt.Errorf("configuration incorrect, HeaderProfile must be empty or %q but got %q",
+			headerProfileOAuth2Proxy, config.HeaderProfile))
+	}
+	switch config.ClaimsHeaderMode {
+	case "", claimsHeaderModeHeaders, claimsHeaderModeJSON:
+	default:
+		check(fmt.Errorf("configuration incorrect, ClaimsHeaderMode must be %q or %q but got %q",
+			claimsHeaderModeHeaders, claimsHeaderModeJSON, config.ClaimsHeaderMode))
+	}
+	if config.MaxForwardedClaims < 0 || config.MaxForwardedClaimBytes < 0 {
+		check(fmt.Errorf("configuration incorrect, claim limits must not be negative"))
+	}
+	for _, option := range []struct {
+		name  string
+		value int
+	}{
+		{"UnauthorizedStatus", config.UnauthorizedStatus},
+		{"ForbiddenStatus", config.ForbiddenStatus},
+	} {
+		if option.value != 0 && (option.value < 400 || option.value > 499) {
+			check(fmt.Errorf("configuration incorrect, %s must be a 4xx status code but got %d", option.name, option.value))
+		}
+	}
+	for _, option := range []struct{ name, value string }{
+		{"ClockSkew", config.ClockSkew},
+		{"FutureSkew", config.FutureSkew},
+		{"PastSkew", config.PastSkew},
+		{"ForcedRefreshInterval", config.ForcedRefreshInterval},
+		{"MaxTokenLifetime", config.MaxTokenLifetime},
+		{"MaxAuthAge", config.MaxAuthAge},
+		{"ConfigFileInterval", config.ConfigFileInterval},
+		{"AuthzTimeout", config.AuthzTimeout},
+	} {
+		_, err = parseDurationOption(option.name, option.value, 0)
+		check(err)
+	}
+
+	for _, header := range []string{config.HeaderName, config.UIDHeader, config.ClaimHeaderPrefix, config.ReissueHeader, config.KeyIDHeader,
+		config.ExternalKeyIDHeader, config.TokenJSONHeader, config.ForwardAuthMethodHeader, config.ProjectIDHeader, config.TokenSourceHeader, config.ForwardTokenHeader} {
+		if header != "" && !isValidHeaderName(header) {
+			check(fmt.Errorf("configuration incorrect, %q is not a valid header name", header))
+		}
+	}
+	if config.CookieName != "" && !isValidHeaderName(config.CookieName) {
+		check(fmt.Errorf("configuration incorrect, %q is not a valid cookie name", config.CookieName))
+	}
+	if config.WebSocketProtocol != "" && !isValidHeaderName(config.WebSocketProtocol) {
+		check(fmt.Errorf("configuration incorrect, %q is not a valid WebSocket subprotocol", config.WebSocketProtocol))
+	}
+	if !isValidHeaderValue(config.Realm) {
+		check(fmt.Errorf("configuration incorrect, Realm must be printable ASCII but got %q", config.Realm))
+	}
+	if config.StripQueryParam && config.QueryParam == "" {
+		check(fmt.Errorf("configuration incorrect, StripQueryParam requires QueryParam"))
+	}
+	// Identity headers are stripped from every request before the token is looked for, so they
+	// must not overlap the headers the token and the request context are read from.
+	inbound := config.inboundHeaders()
+	claimPrefix := config.ClaimHeaderPrefix
+	if claimPrefix == "" {
+		claimPrefix = claimHeaderPrefix
+	}
+	for _, name := range inbound {
+		if strings.HasPrefix(strings.ToLower(name), strings.ToLower(claimPrefix)) {
+			check(fmt.Errorf("configuration incorrect, ClaimHeaderPrefix %q would strip the %s request header", claimPrefix, name))
+		}
+	}
+	for _, option := range []struct{ name, value string }{
+		{"UIDHeader", config.UIDHeader},
+		{"KeyIDHeader", config.KeyIDHeader},
+		{"ProjectIDHeader", config.ProjectIDHeader},
+		{"TokenJSONHeader", config.TokenJSONHeader},
+		{"ForwardAuthMethodHeader", config.ForwardAuthMethodHeader},
+		{"TokenSourceHeader", config.TokenSourceHeader},
+		{"ForwardTokenHeader", config.ForwardTokenHeader},
+	} {
+		if option.value != "" && containsString(inbound, http.CanonicalHeaderKey(option.value)) {
+			check(fmt.Errorf("configuration incorrect, %s must not be the %s request header", option.name, http.CanonicalHeaderKey(option.value)))
+		}
+	}
+	for claim, header := range config.ClaimHeaderMap {
+		if containsString(inbound, http.CanonicalHeaderKey(header)) {
+			check(fmt.Errorf("configuration incorrect, ClaimHeaderMap maps %q to the %s request header", claim, http.CanonicalHeaderKey(header)))
+		}
+	}
+	for claim, encoding := range config.ClaimEncodings {
+		check(validateClaimEncoding(fmt.Sprintf("ClaimEncodings[%q]", claim), encoding))
+	}
+	if config.ClaimEncoding != "" {
+		check(validateClaimEncoding("ClaimEncoding", config.ClaimEncoding))
+	}
+	for claim, header := range config.ClaimHeaderMap {
+		if !isValidHeaderName(header) {
+			check(fmt.Errorf("configuration incorrect, ClaimHeaderMap maps %q to invalid header name %q", claim, header))
+		}
+	}
+	for _, scheme := range config.AuthSchemes {
+		if !isValidHeaderName(scheme) {
+			check(fmt.Errorf("configuration incorrect, %q is not a valid authorization scheme", scheme))
+		}
+	}
+	for _, source := range config.TokenSources {
+		switch source {
+		case tokenSourceHeader, tokenSourceCookie, tokenSourceQuery, tokenSourceForm, tokenSourceWebSocket:
+		default:
+			check(fmt.Errorf("configuration incorrect, TokenSources must contain %q, %q, %q, %q or %q but got %q",
+				tokenSourceHeader, tokenSourceCookie, tokenSourceQuery, tokenSourceForm, tokenSourceWebSocket, source))
+		}
+	}
+	for _, tokenType := range config.TokenTypes {
+		if tokenType != tokenTypeIDToken && tokenType != tokenTypeSessionCookie {
+			check(fmt.Errorf("configuration incorrect, TokenTypes must contain %q or %q but got %q",
+				tokenTypeIDToken, tokenTypeSessionCookie, tokenType))
+		}
+	}
+	if config.Policy != "" {
+		if _, err := compileExpr(config.Policy); err != nil {
+			check(fmt.Errorf("configuration incorrect, invalid Policy: %v", err))
+		}
+	}
+	check(validatePolicies(config.Policies, config.Groups))
+	_, err = parseErrorTemplates(config.ErrorTemplates)
+	check(err)
+	for _, pattern := range append(append([]string(nil), config.AllowedUIDs...), config.BlockedUIDs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			check(fmt.Errorf("configuration incorrect, invalid UID pattern %q: %v", pattern, err))
+		}
+	}
+	if len(config.AllowedRoles) > 0 && config.RolesClaim == "" {
+		check(fmt.Errorf("configuration incorrect, AllowedRoles requires RolesClaim"))
+	}
+
+	_, err = parseProxyURL(config.ProxyURL)
+	check(err)
+	if config.AuthzURL != "" {
+		if u, err := url.Parse(config.AuthzURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			check(fmt.Errorf("configuration incorrect, AuthzURL must be an absolute http or https URL but got %q", config.AuthzURL))
+		}
+	}
+	if config.RedirectURL != "" {
+		u, err := url.Parse(config.RedirectURL)
+		absolute := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		path := err == nil && u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+		if !absolute && !path {
+			check(fmt.Errorf("configuration incorrect, RedirectURL must be an absolute http or https URL or a path but got %q", config.RedirectURL))
+		}
+	}
+	if config.RedirectParam != "" && config.RedirectURL == "" {
+		check(fmt.Errorf("configuration incorrect, RedirectParam requires RedirectURL"))
+	}
+	if len(config.StaticPublicKeysPEM) > 0 {
+		if config.KeySource != nil {
+			check(fmt.Errorf("configuration incorrect, StaticPublicKeysPEM and KeySource are mutually exclusive"))
+		}
+		_, err = newStaticKeySourceFromPEM(config.StaticPublicKeysPEM)
+		check(err)
+	}
+	if config.ReissueToken {
+		_, err = newConfiguredSigner(config, "")
+		check(err)
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return problems[0]
+	}
+	msgs := make([]string, len(problems))
+	for i, problem := range problems {
+		msgs[i] = strings.TrimPrefix(problem.Error(), "configuration incorrect, ")
+	}
+	return fmt.Errorf("configuration incorrect, %d problems: %s", len(problems), strings.Join(msgs, "; "))
+}
+
+// newSettings validates config and builds the settings for the plugin with the given name. If
+// prev is non-nil, its public key caches are reused when possible.
+func newSettings(config *Config, name string, prev *settings) (*settings, error) {
+	config, err := config.expandEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	projectID := resolveProjectID(config)
+	var extraProjectIDs []string
+	for _, id := range config.ProjectIDs {
+		if id = strings.TrimSpace(id); id != projectID {
+			extraProjectIDs = append(extraProjectIDs, id)
+		}
+	}
+
+	dryRun, err := parseEnforceMode(config.EnforceMode)
+	if err != nil {
+		return nil, err
+	}
+	claimOverflow, err := parseClaimOverflow(config.ClaimOverflow)
+	if err != nil {
+		return nil, err
+	}
+	clockSkew, err := parseDurationOption("ClockSkew", config.ClockSkew, clockSkewSeconds*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	futureSkew, err := parseDurationOption("FutureSkew", config.FutureSkew, clockSkew)
+	if err != nil {
+		return nil, err
+	}
+	pastSkew, err := parseDurationOption("PastSkew", config.PastSkew, clockSkew)
+	if err != nil {
+		return nil, err
+	}
+	refreshInterval, err := parseDurationOption("ForcedRefreshInterval", config.ForcedRefreshInterval, forcedRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+	maxTokenLifetime, err := parseDurationOption("MaxTokenLifetime", config.MaxTokenLifetime, 0)
+	if err != nil {
+		return nil, err
+	}
+	maxAuthAge, err := parseDurationOption("MaxAuthAge", config.MaxAuthAge, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	uidHeader := config.UIDHeader
+	if uidHeader == "" {
+		uidHeader = userIDHeader
+	}
+	claimPrefix := config.ClaimHeaderPrefix
+	if claimPrefix == "" {
+		claimPrefix = claimHeaderPrefix
+	}
+	headerName := defaultAuthHeader
+	if config.HeaderName != "" {
+		headerName = http.CanonicalHeaderKey(config.HeaderName)
+	}
+	authSchemes := config.AuthSchemes
+	if authSchemes == nil {
+		authSchemes = []string{defaultAuthScheme}
+	}
+	tokenSources := config.TokenSources
+	if len(tokenSources) == 0 {
+		tokenSources = defaultTokenSources
+	}
+	tokenTypes := config.TokenTypes
+	if len(tokenTypes) == 0 {
+		tokenTypes = []string{tokenTypeIDToken}
+	}
+
+	hc, err := newHTTPClient(config.ProxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	idTokenVerifier, err := newIDTokenVerifier(context.Background(), projectID, hc)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionCookieVerifier, err := newSessionCookieVerifier(context.Background(), projectID, hc)
+	if err != nil {
+		return nil, err
+	}
+
+	var staticKeys KeySource
+	if len(config.StaticPublicKeysPEM) > 0 {
+		staticKeys, err = newStaticKeySourceFromPEM(config.StaticPublicKeysPEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tv := range []*tokenVerifier{idTokenVerifier, sessionCookieVerifier} {
+		configureVerifier(tv, config)
+		tv.extraProjectIDs = extraProjectIDs
+		if staticKeys != nil {
+			tv.keySource = staticKeys
+		}
+		tv.futureSkew = futureSkew
+		tv.pastSkew = pastSkew
+		tv.maxTokenLifetime = maxTokenLifetime
+		tv.maxAuthAge = maxAuthAge
+	}
+
+	// Keep the key caches warm across reloads unless the way keys are fetched has changed. Only
+	// the caches of Google's endpoints are kept: static keys that are no longer configured must
+	// not outlive their configuration.
+	if prev != nil && config.KeySource == nil && staticKeys == nil && config.ProxyURL == prev.proxyURL {
+		if ks, ok := prev.verifier.keySource.(*httpKeySource); ok {
+			idTokenVerifier.keySource = ks
+		}
+		if ks, ok := prev.cookieVerifier.keySource.(*httpKeySource); ok {
+			sessionCookieVerifier.keySource = ks
+		}
+	}
+
+	for _, tv := range []*tokenVerifier{idTokenVerifier, sessionCookieVerifier} {
+		if ks, ok := tv.keySource.(*httpKeySource); ok {
+			ks.Mutex.Lock()
+			ks.minForcedRefreshInterval = refreshInterval
+			ks.Mutex.Unlock()
+		}
+	}
+
+	var policy expr
+	if config.Policy != "" {
+		if policy, err = compileExpr(config.Policy); err != nil {
+			return nil, fmt.Errorf("configuration incorrect, invalid Policy: %v", err)
+		}
+	}
+
+	errorTemplates, err := parseErrorTemplates(config.ErrorTemplates)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &settings{
+		name:                name,
+		proxyURL:            config.ProxyURL,
+		dryRun:              dryRun,
+		failOpen:            config.FailOpenOnKeySourceError,
+		uidHeader:           uidHeader,
+		claimPrefix:         claimPrefix,
+		headerName:          headerName,
+		authSchemes:         authSchemes,
+		multipleAuthHeaders: config.AllowMultipleAuthHeaders,
+		basicAuth:           config.AcceptBasicAuth,
+		cookieName:          config.CookieName,
+		queryParam:          config.QueryParam,
+		stripQueryParam:     config.StripQueryParam,
+		formField:           config.FormField,
+		webSocketProtocol:   config.WebSocketProtocol,
+		tokenSources:        tokenSources,
+		tokenSourceHeader:   config.TokenSourceHeader,
+		stripToken:          config.StripAuthorizationHeader,
+		forwardExpiry:       config.ForwardExpiresIn,
+		keyIDHeader:         config.KeyIDHeader,
+		projectIDHeader:     config.ProjectIDHeader,
+		tokenJSONHeader:     config.TokenJSONHeader,
+		authMethodHeader:    config.ForwardAuthMethodHeader,
+		skipOptions:         config.SkipOptions,
+		allowPreflight:      config.AllowPreflight,
+		optional:            config.Optional,
+		debug:               config.Debug,
+		externalKeyIDHeader: config.ExternalKeyIDHeader,
+		inboundHeaders:      config.inboundHeaders(),
+		verifier:            idTokenVerifier,
+		cookieVerifier:      sessionCookieVerifier,
+		tokenTypes:          tokenTypes,
+		maxClaims:           config.MaxForwardedClaims,
+		maxClaimBytes:       config.MaxForwardedClaimBytes,
+		claimOverflow:       claimOverflow,
+		claimsAsJSON:        config.ClaimsHeaderMode == claimsHeaderModeJSON,
+		forwardClaims:       config.ForwardClaims,
+		claimHeaderMap:      config.ClaimHeaderMap,
+		claimEncoding:       config.ClaimEncoding,
+		claimEncodings:      config.ClaimEncodings,
+		forwardFirebase:     config.ForwardFirebaseInfo,
+		forwardTokenHeader:  config.ForwardTokenHeader,
+		oauth2ProxyHeaders:  config.HeaderProfile == headerProfileOAuth2Proxy,
+		denyAnonymous:       config.DenyAnonymousUsers,
+		verifiedEmailOnly:   config.RequireEmailVerified,
+		allowedProviders:    config.AllowedProviders,
+		allowedUIDs:         config.AllowedUIDs,
+		blockedUIDs:         config.BlockedUIDs,
+		allowedTenants:      config.AllowedTenants,
+		requiredClaims:      config.RequiredClaims,
+		policy:              policy,
+		policies:            config.Policies,
+		groups:              config.Groups,
+		rolesClaim:          config.RolesClaim,
+		allowedRoles:        config.AllowedRoles,
+		onDecision:          config.OnDecision,
+		onUnauthorized:      config.OnUnauthorized,
+		unauthorizedStatus:  http.StatusUnauthorized,
+		forbiddenStatus:     http.StatusForbidden,
+		realm:               config.Realm,
+		jsonErrors:          config.JSONErrors,
+		errorTemplates:      errorTemplates,
+		redirectURL:         config.RedirectURL,
+		redirectParam:       config.RedirectParam,
+	}
+	if config.UnauthorizedStatus != 0 {
+		st.unauthorizedStatus = config.UnauthorizedStatus
+	}
+	if config.ForbiddenStatus != 0 {
+		st.forbiddenStatus = config.ForbiddenStatus
+	}
+
+	if config.AuthzURL != "" {
+		timeout, err := parseDurationOption("AuthzTimeout", config.AuthzTimeout, defaultAuthzTimeout)
+		if err != nil {
+			return nil, err
+		}
+		st.authz = &authzClient{
+			name:     name,
+			url:      config.AuthzURL,
+			client:   &http.Client{Timeout: timeout},
+			failOpen: config.AuthzFailOpen,
+		}
+	}
+
+	if config.ReissueToken {
+		signer, err := newConfiguredSigner(config, name)
+		if err != nil {
+			return nil, err
+		}
+		st.signer = signer
+		st.signerHeader = config.ReissueHeader
+		if st.signerHeader == "" {
+			st.signerHeader = defaultReissueHeader
+		}
+	}
+
+	return st, nil
+}
+
+// configureVerifier applies the token checks selected in the config to the given verifier.
+func configureVerifier(tv *tokenVerifier, config *Config) {
+	tv.allowedIssuers = config.AllowedIssuers
+	tv.audiences = config.Audiences
+	switch {
+	case config.MaxSubjectLength > 0:
+		tv.maxSubjectLength = config.MaxSubjectLength
+	case config.MaxSubjectLength < 0:
+		tv.maxSubjectLength = 0
+	default:
+		tv.maxSubjectLength = maxSubjectLength
+	}
+	tv.strictJSON = config.StrictJSON
+	tv.requireFirebaseClaim = config.RequireFirebaseClaim
+	tv.signatureFirst = config.SignatureFirst
+	tv.skipCustomTokenCheck = config.SkipCustomTokenCheck
+	tv.externalKeyID = config.ExternalKeyIDHeader != ""
+	tv.emulatorMode = config.EmulatorMode
+	if config.KeySource != nil {
+		tv.keySource = config.KeySource
+	}
+}
+
+// newStaticKeySourceFromPEM parses the given PEM-encoded certificates or public keys, keyed by
+// kid, into a static key source.
+func newStaticKeySourceFromPEM(keys map[string]string) (KeySource, error) {
+	var parsed []*PublicKey
+	for kid, key := range keys {
+		pk, err := parsePublicKey(kid, []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("configuration incorrect, invalid StaticPublicKeysPEM entry %q: %v", kid, err)
+		}
+		parsed = append(parsed, pk)
+	}
+	sortKeys(parsed)
+	return NewStaticKeySource(parsed), nil
+}
+
+// newHTTPClient returns the client used to fetch public keys, going through proxyURL if set.
+func newHTTPClient(proxyURL string) (*http.Client, error) {
+	u, err := parseProxyURL(proxyURL)
+	if err != nil || u == nil {
+		return &http.Client{}, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	return &http.Client{Transport: transport}, nil
+}
+
+// parseProxyURL parses and checks the ProxyURL option, returning nil when it is empty.
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	if proxyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("configuration incorrect, invalid ProxyURL: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("configuration incorrect, ProxyURL scheme must be http, https or socks5 but got %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("configuration incorrect, ProxyURL %q has no host", proxyURL)
+	}
+	return u, nil
+}
+
+// parseEnforceMode parses the EnforceMode option, reporting whether it selects dry-run mode.
+func parseEnforceMode(mode string) (bool, error) {
+	switch mode {
+	case "", enforceModeEnforce:
+		return false, nil
+	case enforceModeDryRun:
+		return true, nil
+	}
+	return false, fmt.Errorf("configuration incorrect, EnforceMode must be %q or %q but got %q",
+		enforceModeEnforce, enforceModeDryRun, mode)
+}
+
+// parseClaimOverflow parses the ClaimOverflow option, defaulting to truncation.
+func parseClaimOverflow(mode string) (string, error) {
+	switch mode {
+	case "":
+		return claimOverflowTruncate, nil
+	case claimOverflowTruncate, claimOverflowJSON:
+		return mode, nil
+	}
+	return "", fmt.Errorf("configuration incorrect, ClaimOverflow must be %q or %q but got %q",
+		claimOverflowTruncate, claimOverflowJSON, mode)
+}
+
+func validateClaimEncoding(option, encoding string) error {
+	switch encoding {
+	case claimEncodingRaw, claimEncodingURL, claimEncodingBase64, claimEncodingDrop:
+		return nil
+	}
+	return fmt.Errorf("configuration incorrect, %s must be %q, %q, %q or %q but got %q", option,
+		claimEncodingRaw, claimEncodingURL, claimEncodingBase64, claimEncodingDrop, encoding)
+}
+
+// parseDurationOption parses the named duration option, returning def when it is empty.
+func parseDurationOption(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("configuration incorrect, invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+// resolveProjectID returns the configured ProjectID or else the first of ProjectIDs, falling
+// back to the GOOGLE_CLOUD_PROJECT and GCLOUD_PROJECT environment variables the same way the
+// Firebase SDK does.
+func resolveProjectID(config *Config) string {
+	if projectID := strings.TrimSpace(config.ProjectID); projectID != "" {
+		return projectID
+	}
+	if len(config.ProjectIDs) > 0 {
+		return strings.TrimSpace(config.ProjectIDs[0])
+	}
+	for _, env := range []string{"GOOGLE_CLOUD_PROJECT", "GCLOUD_PROJECT"} {
+		if projectID := strings.TrimSpace(os.Getenv(env)); projectID != "" {
+			return projectID
+		}
+	}
+	return ""
+}
+
+func newConfiguredSigner(config *Config, name string) (*tokenSigner, error) {
+	ttlValue := config.ReissueTTL
+	if ttlValue == "" {
+		ttlValue = defaultReissueTTL
+	}
+	ttl, err := time.ParseDuration(ttlValue)
+	if err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("configuration incorrect, invalid ReissueTTL %q", config.ReissueTTL)
+	}
+
+	switch config.ReissueAlgorithm {
+	case "", algHS256:
+		if config.ReissueSecret == "" {
+			return nil, fmt.Errorf("configuration incorrect, missing ReissueSecret")
+		}
+		return newHS256Signer(name, []byte(config.ReissueSecret), config.ReissueClaims, ttl)
+	case algRS256:
+		if config.ReissuePrivateKey == "" {
+			return nil, fmt.Errorf("configuration incorrect, missing ReissuePrivateKey")
+		}
+		signer, err := newRS256Signer(name, []byte(config.ReissuePrivateKey), config.ReissueClaims, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("configuration incorrect, invalid ReissuePrivateKey: %v", err)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("configuration incorrect, ReissueAlgorithm must be %q or %q but got %q",
+			algHS256, algRS256, config.ReissueAlgorithm)
+	}
+}
+
+// inboundHeaders returns the canonical names of the request headers the middleware reads: the
+// token sources, and the headers ServeHTTP and the upstream rely on to describe the request.
+// stripIdentityHeaders never deletes them.
+func (config *Config) inboundHeaders() []string {
+	headers := []string{defaultAuthHeader, "Cookie", webSocketProtocolHeader, "Content-Type", "Accept", "Origin",
+		"Access-Control-Request-Method", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto"}
+	for _, header := range []string{config.HeaderName, config.ExternalKeyIDHeader} {
+		if header != "" {
+			headers = append(headers, header)
+		}
+	}
+	for i, header := range headers {
+		headers[i] = http.CanonicalHeaderKey(header)
+	}
+	return headers
+}
+
+// isValidProjectID reports whether id looks like a Google Cloud project id: 6 to 30 lower-case
+// letters, digits and hyphens, starting with a letter and not ending with a hyphen. Legacy ids
+// may carry a domain prefix such as "example.com:".
+func isValidProjectID(id string) bool {
+	if i := strings.LastIndexByte(id, ':'); i >= 0 {
+		id = id[i+1:]
+	}
+	if len(id) < 6 || len(id) > 30 || id[0] < 'a' || id[0] > 'z' || id[len(id)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidHeaderName reports whether name is a legal HTTP header field name, i.e. a non-empty
+// RFC 7230 token.
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
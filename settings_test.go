@@ -0,0 +1,326 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setenv sets an environment variable for the duration of the test; an empty value unsets it.
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	if value == "" {
+		os.Unsetenv(key)
+	} else {
+		os.Setenv(key, value)
+	}
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestResolveProjectID(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		googleEnv  string
+		gcloudEnv  string
+		wantResult string
+	}{
+		{"config wins", "from-config", "from-google", "from-gcloud", "from-config"},
+		{"GOOGLE_CLOUD_PROJECT", "", "from-google", "from-gcloud", "from-google"},
+		{"GCLOUD_PROJECT", "", "", "from-gcloud", "from-gcloud"},
+		{"none", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, "GOOGLE_CLOUD_PROJECT", tt.googleEnv)
+			setenv(t, "GCLOUD_PROJECT", tt.gcloudEnv)
+			if got := resolveProjectID(&Config{ProjectID: tt.config}); got != tt.wantResult {
+				t.Errorf("resolveProjectID() = %q, want %q", got, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestNewProjectIDFromEnvironment(t *testing.T) {
+	setenv(t, "GOOGLE_CLOUD_PROJECT", "")
+	setenv(t, "GCLOUD_PROJECT", "")
+	cfg := CreateConfig()
+	cfg.KeySource = testKeySource()
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Fatal("New succeeded without a project ID")
+	}
+
+	setenv(t, "GCLOUD_PROJECT", testProjectID)
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+	if err != nil {
+		t.Fatalf("New failed with GCLOUD_PROJECT set: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+}
+
+// TestTraefikTestData loads the testData of .traefik.yml, which Traefik uses to check that
+// the plugin starts, through New.
+func TestTraefikTestData(t *testing.T) {
+	manifest, err := os.ReadFile(".traefik.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifest only holds flat string options, so a line-based reader is enough.
+	testData := map[string]string{}
+	inTestData := false
+	for _, line := range strings.Split(string(manifest), "\n") {
+		if !strings.HasPrefix(line, " ") {
+			inTestData = strings.TrimSpace(line) == "testData:"
+			continue
+		}
+		if kv := strings.SplitN(strings.TrimSpace(line), ":", 2); inTestData && len(kv) == 2 {
+			testData[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	if len(testData) == 0 {
+		t.Fatal(".traefik.yml has no testData")
+	}
+
+	cfg := CreateConfig()
+	if err := json.Unmarshal(mustMarshal(t, testData), cfg); err != nil {
+		t.Fatal(err)
+	}
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatalf("New rejected the testData of .traefik.yml: %v", err)
+	}
+	h.(*FirebaseJwtPlugin).Close()
+}
+
+func TestProxyURL(t *testing.T) {
+	keys := mustMarshal(t, map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)})
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+		if !ok || user != "gateway" || password != "s3cret" {
+			http.Error(rw, "proxy authentication required", http.StatusProxyAuthRequired)
+			return
+		}
+		proxied = append(proxied, req.URL.String())
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Write(keys)
+	}))
+	defer proxy.Close()
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.ProxyURL = "http://gateway:s3cret@" + strings.TrimPrefix(proxy.URL, "http://")
+	plugin := newTestPlugin(t, cfg)
+	// Fetch the keys over plain HTTP, so the proxy sees the request rather than a CONNECT.
+	ks := plugin.current().verifier.keySource.(*httpKeySource)
+	ks.KeyURI = "http://keys.example.invalid/certs"
+
+	if _, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, nil)); err != nil {
+		t.Fatalf("VerifyIDToken() error = %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != ks.KeyURI {
+		t.Errorf("proxied requests = %v, want one for %s", proxied, ks.KeyURI)
+	}
+}
+
+// parseProxyAuthorization decodes a basic Proxy-Authorization header.
+func parseProxyAuthorization(value string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": {value}}}
+	return req.BasicAuth()
+}
+
+func TestInvalidProxyURL(t *testing.T) {
+	for _, proxyURL := range []string{"ftp://proxy:21", "http://", "://bad"} {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.ProxyURL = proxyURL
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Errorf("New accepted ProxyURL %q", proxyURL)
+		}
+	}
+}
+
+func TestReloadKeySources(t *testing.T) {
+	staticPEM := map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)}
+	tests := []struct {
+		name     string
+		before   func(*Config)
+		after    func(*Config)
+		wantKept bool
+		wantHTTP bool
+	}{
+		{"Google keys are kept", func(*Config) {}, func(*Config) {}, true, true},
+		{"Google keys with a new proxy", func(*Config) {}, func(cfg *Config) { cfg.ProxyURL = "http://proxy.example.com:3128" }, false, true},
+		{"static keys removed", func(cfg *Config) { cfg.StaticPublicKeysPEM = staticPEM }, func(*Config) {}, false, true},
+		{"library key source removed", func(cfg *Config) { cfg.KeySource = testKeySource() }, func(*Config) {}, false, true},
+		{"static keys added", func(*Config) {}, func(cfg *Config) { cfg.StaticPublicKeysPEM = staticPEM }, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			tt.before(cfg)
+			plugin := newTestPlugin(t, cfg)
+			before := plugin.current()
+
+			cfg = CreateConfig()
+			cfg.ProjectID = testProjectID
+			tt.after(cfg)
+			if err := plugin.Reload(cfg); err != nil {
+				t.Fatal(err)
+			}
+			after := plugin.current()
+
+			for _, pair := range [][2]*tokenVerifier{{before.verifier, after.verifier}, {before.cookieVerifier, after.cookieVerifier}} {
+				if kept := pair[0].keySource == pair[1].keySource; kept != tt.wantKept {
+					t.Errorf("key source kept = %v, want %v", kept, tt.wantKept)
+				}
+				if _, isHTTP := pair[1].keySource.(*httpKeySource); isHTTP != tt.wantHTTP {
+					t.Errorf("key source after reload is %T", pair[1].keySource)
+				}
+			}
+		})
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+	before := plugin.current()
+
+	invalid := CreateConfig()
+	invalid.ProjectID = "x"
+	if err := plugin.Reload(invalid); err == nil {
+		t.Fatal("Reload accepted an invalid project ID")
+	}
+	if plugin.current() != before {
+		t.Error("a failed Reload replaced the configuration")
+	}
+}
+
+func TestReloadDuringRequests(t *testing.T) {
+	// Each configuration forwards the UID under its own header and accepts its own project, so
+	// a request seeing a mix of both would be forwarded with the wrong header or rejected.
+	configs := make([]*Config, 2)
+	for i, project := range []string{testProjectID, "proj-2"} {
+		cfg := CreateConfig()
+		cfg.ProjectIDs = []string{project, testProjectID}
+		cfg.KeySource = testKeySource()
+		cfg.UIDHeader = fmt.Sprintf("X-User-%d", i)
+		configs[i] = cfg
+	}
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		found := 0
+		for _, name := range []string{"X-User-0", "X-User-1"} {
+			if req.Header.Get(name) != "" {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("request forwarded with %d UID headers: %v", found, req.Header)
+		}
+	}), configs[0], "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := h.(*FirebaseJwtPlugin)
+	token := mintTestToken(t, nil)
+
+	done := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := plugin.Reload(configs[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	var requests sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for i := 0; i < 200; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				rw := httptest.NewRecorder()
+				h.ServeHTTP(rw, req)
+				if rw.Code != http.StatusOK {
+					t.Errorf("status = %d during reload", rw.Code)
+					return
+				}
+			}
+		}()
+	}
+	requests.Wait()
+	close(done)
+	reloads.Wait()
+}
+
+func TestStaticPublicKeysPEM(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    map[string]string
+		wantErr bool
+	}{
+		{"certificate", map[string]string{testKeyID: certificatePEM(t, testKey)}, false},
+		{"public key", map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)}, false},
+		{"signing kid not provided", map[string]string{"k2": certificatePEM(t, testKey)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.StaticPublicKeysPEM = tt.keys
+			// Keys must never be fetched in air-gapped mode.
+			cfg.ProxyURL = "http://127.0.0.1:1"
+			plugin := newTestPlugin(t, cfg)
+			_, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, nil))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if isKeySourceError(err) {
+				t.Errorf("VerifyIDToken() tried to fetch keys: %v", err)
+			}
+		})
+	}
+}
+
+func TestInvalidStaticPublicKeysPEM(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.StaticPublicKeysPEM = map[string]string{testKeyID: "not a PEM block"}
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("New accepted an invalid StaticPublicKeysPEM entry")
+	}
+}
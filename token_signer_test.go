@@ -0,0 +1,155 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReissueToken(t *testing.T) {
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := "gateway-secret"
+	verifyHS256 := func(content string, signature []byte) bool {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(content))
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	verifyRS256 := func(content string, signature []byte) bool {
+		digest := sha256.Sum256([]byte(content))
+		return rsa.VerifyPKCS1v15(&testKey.PublicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	tests := []struct {
+		name   string
+		config func(*Config)
+		alg    string
+		verify func(content string, signature []byte) bool
+	}{
+		{"HS256", func(cfg *Config) {
+			cfg.ReissueSecret = secret
+		}, algHS256, verifyHS256},
+		{"RS256 PKCS#1", func(cfg *Config) {
+			cfg.ReissueAlgorithm = algRS256
+			cfg.ReissuePrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKey)}))
+		}, algRS256, verifyRS256},
+		{"RS256 PKCS#8", func(cfg *Config) {
+			cfg.ReissueAlgorithm = algRS256
+			cfg.ReissuePrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+		}, algRS256, verifyRS256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.ReissueToken = true
+			cfg.ReissueHeader = "X-Gateway-Token"
+			cfg.ReissueTTL = "2m"
+			cfg.ReissueClaims = []string{"role", "absent"}
+			tt.config(cfg)
+			var assertion string
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				assertion = req.Header.Get("X-Gateway-Token")
+			}), cfg, "gateway")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{"role": "admin", "plan": "pro"}))
+			rw := httptest.NewRecorder()
+			before := time.Now().Unix()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+
+			parts := strings.Split(assertion, ".")
+			if len(parts) != 3 {
+				t.Fatalf("reissued token %q is not a compact JWT", assertion)
+			}
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.verify(parts[0]+"."+parts[1], signature) {
+				t.Error("reissued token signature does not verify")
+			}
+
+			var header jwtHeader
+			decodeTestSegment(t, parts[0], &header)
+			if header.Algorithm != tt.alg || header.Type != "JWT" {
+				t.Errorf("header = %+v, want alg %s", header, tt.alg)
+			}
+			var claims map[string]interface{}
+			decodeTestSegment(t, parts[1], &claims)
+			for name, want := range map[string]interface{}{"iss": "gateway", "sub": "user-1", "uid": "user-1", "role": "admin"} {
+				if claims[name] != want {
+					t.Errorf("%s = %v, want %v", name, claims[name], want)
+				}
+			}
+			for _, name := range []string{"plan", "absent", "aud", "firebase"} {
+				if value, ok := claims[name]; ok {
+					t.Errorf("%s = %v, want it left out", name, value)
+				}
+			}
+			iat, _ := claims["iat"].(float64)
+			exp, _ := claims["exp"].(float64)
+			if int64(iat) < before || int64(iat) > time.Now().Unix() {
+				t.Errorf("iat = %v, want the time of the request", claims["iat"])
+			}
+			if exp-iat != 120 {
+				t.Errorf("exp - iat = %v, want the ReissueTTL of 120s", exp-iat)
+			}
+		})
+	}
+}
+
+func decodeTestSegment(t *testing.T, segment string, v interface{}) {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMintTokenVerifies checks that tokens minted for tests pass the full verification path.
+func TestMintTokenVerifies(t *testing.T) {
+	token, err := MintToken(testKey, testKeyID, map[string]interface{}{
+		"iss":  idTokenIssuerPrefix + testProjectID,
+		"aud":  testProjectID,
+		"sub":  "user-9",
+		"iat":  time.Now().Unix(),
+		"exp":  time.Now().Add(time.Hour).Unix(),
+		"role": "admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	verified, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.UID != "user-9" || verified.Claims["role"] != "admin" || verified.KeyID != testKeyID {
+		t.Errorf("verified token = %+v", verified)
+	}
+}
@@ -2,6 +2,7 @@ package firebase_verify_token
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto"
 	"crypto/rsa"
@@ -12,8 +13,11 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +30,8 @@ const (
 	sessionCookieCertURL      = "https://www.googleapis.com/identitytoolkit/v3/relyingparty/publicKeys"
 	sessionCookieIssuerPrefix = "https://session.firebase.google.com/"
 	clockSkewSeconds          = 300
+	maxSubjectLength          = 128
+	forcedRefreshInterval     = 30 * time.Second
 	firebaseAudience          = "https://identitytoolkit.googleapis.com/google.identity.identitytoolkit.v1.IdentityToolkit"
 )
 
@@ -37,28 +43,67 @@ type tokenVerifier struct {
 	docURL            string
 	projectID         string
 	issuerPrefix      string
-	keySource         keySource
+	keySource         KeySource
+	// extraProjectIDs are further projects whose tokens are accepted besides projectID.
+	extraProjectIDs []string
+	// audiences, when non-empty, replaces the project ids as the accepted 'aud' values.
+	audiences []string
+	// allowedIssuers, when non-empty, replaces the issuer computed from issuerPrefix and
+	// projectID with a set of acceptable issuers.
+	allowedIssuers []string
+	// emulatorMode also accepts the http:// form of the expected issuers, as used by the
+	// Firebase Auth emulator and some test setups.
+	emulatorMode bool
+	// strictJSON rejects tokens whose header or payload contain duplicate top-level keys.
+	strictJSON bool
+	// maxSubjectLength bounds the length of the 'sub' claim; zero disables the check.
+	maxSubjectLength int
+	// externalKeyID accepts tokens without a kid header when a key id is supplied out-of-band
+	// through the context, see withExternalKeyID.
+	externalKeyID bool
+	// skipCustomTokenCheck disables the dedicated error for tokens that look like Firebase
+	// custom tokens, leaving them to the regular kid and audience checks.
+	skipCustomTokenCheck bool
+	// signatureFirst verifies the signature before the content checks, trading CPU for not
+	// disclosing content-specific errors on forged tokens.
+	signatureFirst bool
+	// requireFirebaseClaim rejects tokens without a firebase.sign_in_provider claim.
+	requireFirebaseClaim bool
+	// futureSkew is the tolerance applied to the iat and nbf claims.
+	futureSkew time.Duration
+	// pastSkew is the tolerance applied to the exp claim.
+	pastSkew time.Duration
+	// maxTokenLifetime bounds exp - iat; zero disables the check.
+	maxTokenLifetime time.Duration
+	// maxAuthAge bounds the time since auth_time; zero disables the check.
+	maxAuthAge time.Duration
 }
 
-func newIDTokenVerifier(ctx context.Context, projectID string) (*tokenVerifier, error) {
+func newIDTokenVerifier(ctx context.Context, projectID string, hc *http.Client) (*tokenVerifier, error) {
 	return &tokenVerifier{
 		shortName:         "ID token",
 		articledShortName: "an ID token",
 		docURL:            "https://firebase.google.com/docs/auth/admin/verify-id-tokens",
 		projectID:         projectID,
 		issuerPrefix:      idTokenIssuerPrefix,
-		keySource:         newHTTPKeySource(idTokenCertURL, &http.Client{}),
+		maxSubjectLength:  maxSubjectLength,
+		futureSkew:        clockSkewSeconds * time.Second,
+		pastSkew:          clockSkewSeconds * time.Second,
+		keySource:         newHTTPKeySource(idTokenCertURL, hc),
 	}, nil
 }
 
-func newSessionCookieVerifier(ctx context.Context, projectID string) (*tokenVerifier, error) {
+func newSessionCookieVerifier(ctx context.Context, projectID string, hc *http.Client) (*tokenVerifier, error) {
 	return &tokenVerifier{
 		shortName:         "session cookie",
 		articledShortName: "a session cookie",
 		docURL:            "https://firebase.google.com/docs/auth/admin/manage-cookies",
 		projectID:         projectID,
 		issuerPrefix:      sessionCookieIssuerPrefix,
-		keySource:         newHTTPKeySource(sessionCookieCertURL, &http.Client{}),
+		maxSubjectLength:  maxSubjectLength,
+		futureSkew:        clockSkewSeconds * time.Second,
+		pastSkew:          clockSkewSeconds * time.Second,
+		keySource:         newHTTPKeySource(sessionCookieCertURL, hc),
 	}, nil
 }
 
@@ -76,6 +121,53 @@ func newSessionCookieVerifier(ctx context.Context, projectID string) (*tokenVeri
 // If any of the above conditions are not met, an error is returned. Otherwise a pointer to a
 // decoded Token is returned.
 func (tv *tokenVerifier) VerifyToken(ctx context.Context, token string) (*Token, error) {
+	payload, err := tv.VerifyTokenDetailed(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// VerifyTokenDetailed performs the same checks as VerifyToken, but when the token content could
+// be decoded and validated it returns the decoded Token even if the timestamp or signature
+// checks fail afterwards.
+//
+// The returned Token is unverified whenever err != nil, and must only be used for informational
+// purposes such as telling a user which session expired.
+func (tv *tokenVerifier) VerifyTokenDetailed(ctx context.Context, token string) (*Token, error) {
+	return tv.verify(ctx, token, nil)
+}
+
+// VerificationInfo describes how a token was verified by Introspect.
+type VerificationInfo struct {
+	// KeyID is the kid of the public key that verified the token signature.
+	KeyID string
+	// FromCache reports whether the public keys were served from the cache rather than
+	// freshly fetched.
+	FromCache bool
+	// CacheExpiry is the time at which the cached public keys expire.
+	CacheExpiry time.Time
+	// Elapsed is the total time spent verifying the token.
+	Elapsed time.Duration
+}
+
+// Introspect verifies the given token exactly like VerifyToken and additionally reports metadata
+// about the verification, such as the matching key and the state of the key cache. The info is
+// returned even when verification fails, populated as far as verification got.
+func (tv *tokenVerifier) Introspect(ctx context.Context, token string) (*Token, VerificationInfo, error) {
+	var info VerificationInfo
+	start := time.Now()
+	payload, err := tv.verify(ctx, token, &info)
+	info.Elapsed = time.Since(start)
+	if err != nil {
+		return nil, info, err
+	}
+	return payload, info, nil
+}
+
+// verify runs all token checks. If info is non-nil it is filled in with details about the
+// signature verification.
+func (tv *tokenVerifier) verify(ctx context.Context, token string, info *VerificationInfo) (*Token, error) {
 	if tv.projectID == "" {
 		return nil, errors.New("project id not available")
 	}
@@ -83,120 +175,436 @@ func (tv *tokenVerifier) VerifyToken(ctx context.Context, token string) (*Token,
 		return nil, fmt.Errorf("%s must be a non-empty string", tv.shortName)
 	}
 
-	// Validate the token content first. This is fast and cheap.
-	payload, err := tv.verifyContent(token)
+	jwt, err := parseJWT(token)
 	if err != nil {
-		return nil, fmt.Errorf("%s; see %s for details on how to retrieve a valid %s",
-			err.Error(), tv.docURL, tv.shortName)
+		return nil, tv.withDocURL(err)
 	}
 
-	if err := tv.verifyTimestamps(payload); err != nil {
-		return nil, err
+	if tv.signatureFirst {
+		// Check the signature before reporting anything about the expected content, so that
+		// forged tokens cannot be used to probe the configured issuer and audience.
+		kid, err := tv.verifySignature(ctx, jwt, info)
+		if err != nil {
+			var ksErr *keySourceError
+			if errors.As(err, &ksErr) {
+				// When the keys are unavailable the content checks still run, so that callers
+				// failing open never admit an otherwise invalid token, but their outcome is not
+				// reported for a token whose signature was not checked.
+				if _, contentErr := tv.verifyClaims(jwt); contentErr != nil {
+					ksErr.invalidContent = true
+				}
+			}
+			return nil, err
+		}
+		payload, err := tv.verifyClaims(jwt)
+		if err != nil {
+			return payload, err
+		}
+		setVerifiedKeyID(payload, kid, info)
+		return payload, nil
+	}
+
+	// Validate the token content first. This is fast and cheap.
+	payload, err := tv.verifyClaims(jwt)
+	if err != nil {
+		return payload, err
 	}
 
 	// Verifying the signature requires syncronized access to a key cache and
 	// potentially issues an http request. Therefore we do it last.
-	if err := tv.verifySignature(ctx, token); err != nil {
-		return nil, err
+	kid, err := tv.verifySignature(ctx, jwt, info)
+	if err != nil {
+		return payload, err
 	}
+	setVerifiedKeyID(payload, kid, info)
 	return payload, nil
 }
 
-func (tv *tokenVerifier) verifyContent(token string) (*Token, error) {
-	var (
-		header  jwtHeader
-		payload Token
-	)
+func hasKeyID(keys []*PublicKey, kid string) bool {
+	for _, k := range keys {
+		if k.Kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+// setVerifiedKeyID records the kid of the key that verified the token signature.
+func setVerifiedKeyID(payload *Token, kid string, info *VerificationInfo) {
+	payload.KeyID = kid
+	if info != nil {
+		info.KeyID = kid
+	}
+}
+
+// verifyClaims runs the content and timestamp checks. The decoded payload is returned along
+// with timestamp errors.
+func (tv *tokenVerifier) verifyClaims(jwt *parsedJWT) (*Token, error) {
+	payload, err := tv.verifyContent(jwt)
+	if err != nil {
+		return nil, tv.withDocURL(err)
+	}
+
+	if err := tv.verifyTimestamps(payload); err != nil {
+		return payload, err
+	}
+	return payload, nil
+}
+
+// withDocURL appends a pointer to the documentation on retrieving valid tokens to err.
+func (tv *tokenVerifier) withDocURL(err error) error {
+	return fmt.Errorf("%s; see %s for details on how to retrieve a valid %s",
+		err.Error(), tv.docURL, tv.shortName)
+}
+
+// parsedJWT is a JWT split into its segments, with the header and payload decoded once so
+// that the content and signature checks can share them.
+type parsedJWT struct {
+	segments []string
+	header   jwtHeader
+	payload  []byte
+}
 
+func parseJWT(token string) (*parsedJWT, error) {
 	segments := strings.Split(token, ".")
 	if len(segments) != 3 {
 		return nil, errors.New("incorrect number of segments")
 	}
 
-	if err := decode(segments[0], &header); err != nil {
+	jwt := &parsedJWT{segments: segments}
+	if err := decode(segments[0], &jwt.header); err != nil {
 		return nil, err
 	}
 
-	if err := decode(segments[1], &payload); err != nil {
+	payload, err := decodeSegment(segments[1])
+	if err != nil {
 		return nil, err
 	}
+	jwt.payload = payload
+	return jwt, nil
+}
+
+func (tv *tokenVerifier) verifyContent(jwt *parsedJWT) (*Token, error) {
+	header := jwt.header
+
+	if tv.strictJSON {
+		if err := checkDuplicateKeys(jwt.segments[0]); err != nil {
+			return nil, fmt.Errorf("%s header is invalid: %v", tv.shortName, err)
+		}
+		if err := checkDuplicateKeysDecoded(jwt.payload); err != nil {
+			return nil, fmt.Errorf("%s payload is invalid: %v", tv.shortName, err)
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := unmarshal(jwt.payload, &claims); err != nil {
+		return nil, err
+	}
+	payload, err := newToken(claims)
+	if err != nil {
+		return nil, fmt.Errorf("%s payload is invalid: %v", tv.shortName, err)
+	}
 
-	issuer := tv.issuerPrefix + tv.projectID
 	if header.KeyID == "" {
-		if payload.Audience == firebaseAudience {
+		if payload.Audience == firebaseAudience && !tv.skipCustomTokenCheck {
 			return nil, fmt.Errorf("expected %s but got a custom token", tv.articledShortName)
 		}
-		return nil, fmt.Errorf("%s has no 'kid' header", tv.shortName)
+		if !tv.externalKeyID {
+			return nil, fmt.Errorf("%s has no 'kid' header", tv.shortName)
+		}
 	}
 	if header.Algorithm != "RS256" {
 		return nil, fmt.Errorf("%s has invalid algorithm; expected 'RS256' but got %q",
 			tv.shortName, header.Algorithm)
 	}
-	if payload.Audience != tv.projectID {
-		return nil, fmt.Errorf("%s has invalid 'aud' (audience) claim; expected %q but got %q; %s",
-			tv.shortName, tv.projectID, payload.Audience, tv.getProjectIDMatchMessage())
-	}
-	if payload.Issuer != issuer {
-		return nil, fmt.Errorf("%s has invalid 'iss' (issuer) claim; expected %q but got %q; %s",
-			tv.shortName, issuer, payload.Issuer, tv.getProjectIDMatchMessage())
+	if len(tv.audiences) > 0 {
+		if !containsString(tv.audiences, payload.Audience) {
+			return nil, fmt.Errorf("%s has invalid 'aud' (audience) claim; expected one of %q but got %q",
+				tv.shortName, tv.audiences, payload.Audience)
+		}
+		// The audience says nothing about the project, so any configured project may issue;
+		// the first one whose issuer matches is the project of the token.
+		for _, project := range append([]string{tv.projectID}, tv.extraProjectIDs...) {
+			if project != "" && tv.isAllowedIssuer(payload.Issuer, project) {
+				payload.ProjectID = project
+				break
+			}
+		}
+		if payload.ProjectID == "" {
+			return nil, fmt.Errorf("%s has invalid 'iss' (issuer) claim; expected %s but got %q; %s",
+				tv.shortName, tv.expectedIssuers(tv.projectID), payload.Issuer, tv.getProjectIDMatchMessage())
+		}
+	} else {
+		if !tv.isAllowedProject(payload.Audience) {
+			return nil, fmt.Errorf("%s has invalid 'aud' (audience) claim; expected %s but got %q; %s",
+				tv.shortName, tv.expectedProjects(), payload.Audience, tv.getProjectIDMatchMessage())
+		}
+		if !tv.isAllowedIssuer(payload.Issuer, payload.Audience) {
+			return nil, fmt.Errorf("%s has invalid 'iss' (issuer) claim; expected %s but got %q; %s",
+				tv.shortName, tv.expectedIssuers(payload.Audience), payload.Issuer, tv.getProjectIDMatchMessage())
+		}
+		payload.ProjectID = payload.Audience
 	}
 	if payload.Subject == "" {
 		return nil, fmt.Errorf("%s has empty 'sub' (subject) claim", tv.shortName)
 	}
-	if len(payload.Subject) > 128 {
-		return nil, fmt.Errorf("%s has a 'sub' (subject) claim longer than 128 characters",
-			tv.shortName)
+	if tv.maxSubjectLength > 0 && len(payload.Subject) > tv.maxSubjectLength {
+		return nil, fmt.Errorf("%s has a 'sub' (subject) claim longer than %d characters",
+			tv.shortName, tv.maxSubjectLength)
+	}
+
+	if tv.requireFirebaseClaim && payload.Firebase.SignInProvider == "" {
+		return nil, fmt.Errorf("%s has no 'firebase.sign_in_provider' claim", tv.shortName)
 	}
 
 	payload.UID = payload.Subject
+	return payload, nil
+}
 
-	var customClaims map[string]interface{}
-	if err := decode(segments[1], &customClaims); err != nil {
-		return nil, err
+// newToken builds a Token from the decoded payload, so that the payload is only decoded once.
+// The standard claims are moved from claims into the Token fields, with the type checks
+// encoding/json would apply to them; the remaining claims become Token.Claims.
+func newToken(claims map[string]interface{}) (*Token, error) {
+	t := &Token{}
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{{"iss", &t.Issuer}, {"aud", &t.Audience}, {"sub", &t.Subject}, {"uid", &t.UID}} {
+		if err := stringClaim(claims, field.name, field.value); err != nil {
+			return nil, err
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value *int64
+	}{{"exp", &t.Expires}, {"iat", &t.IssuedAt}, {"nbf", &t.NotBefore}, {"auth_time", &t.AuthTime}} {
+		if err := intClaim(claims, field.name, field.value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch firebase := claims["firebase"].(type) {
+	case nil:
+	case map[string]interface{}:
+		if err := stringClaim(firebase, "sign_in_provider", &t.Firebase.SignInProvider); err != nil {
+			return nil, err
+		}
+		if err := stringClaim(firebase, "tenant", &t.Firebase.Tenant); err != nil {
+			return nil, err
+		}
+		switch identities := firebase["identities"].(type) {
+		case nil:
+		case map[string]interface{}:
+			t.Firebase.Identities = identities
+		default:
+			return nil, fmt.Errorf("'identities' claim must be an object")
+		}
+	default:
+		return nil, fmt.Errorf("'firebase' claim must be an object")
 	}
-	for _, standardClaim := range []string{"iss", "aud", "exp", "iat", "sub", "uid"} {
-		delete(customClaims, standardClaim)
+
+	for _, standardClaim := range []string{"iss", "aud", "exp", "iat", "nbf", "sub", "uid"} {
+		delete(claims, standardClaim)
+	}
+	t.Claims = claims
+	return t, nil
+}
+
+// stringClaim stores the named claim, which must be a string if present, in value.
+func stringClaim(claims map[string]interface{}, name string, value *string) error {
+	switch v := claims[name].(type) {
+	case nil:
+	case string:
+		*value = v
+	default:
+		return fmt.Errorf("'%s' claim must be a string", name)
 	}
-	payload.Claims = customClaims
+	return nil
+}
 
-	return &payload, nil
+// intClaim stores the named claim, which must be an integer if present, in value.
+func intClaim(claims map[string]interface{}, name string, value *int64) error {
+	switch v := claims[name].(type) {
+	case nil:
+	case float64:
+		if v != math.Trunc(v) || v < math.MinInt64 || v >= math.MaxInt64 {
+			return fmt.Errorf("'%s' claim must be an integer", name)
+		}
+		*value = int64(v)
+	default:
+		return fmt.Errorf("'%s' claim must be a number", name)
+	}
+	return nil
 }
 
+// verifyTimestamps checks the iat, nbf and exp claims against the current time. The clock skew
+// tolerances are inclusive: a token issued exactly futureSkew in the future, or that expired
+// exactly pastSkew ago, is still accepted.
 func (tv *tokenVerifier) verifyTimestamps(payload *Token) error {
-	if (payload.IssuedAt - clockSkewSeconds) > time.Now().Unix() {
+	now := time.Now().Unix()
+	futureSkew := int64(tv.futureSkew / time.Second)
+	pastSkew := int64(tv.pastSkew / time.Second)
+	if (payload.IssuedAt - futureSkew) > now {
 		return fmt.Errorf("%s issued at future timestamp: %d", tv.shortName, payload.IssuedAt)
-	} else if (payload.Expires + clockSkewSeconds) < time.Now().Unix() {
-		return fmt.Errorf("%s has expired at: %d", tv.shortName, payload.Expires)
+	} else if (payload.NotBefore - futureSkew) > now {
+		return fmt.Errorf("%s is not valid before: %d", tv.shortName, payload.NotBefore)
+	} else if (payload.Expires + pastSkew) < now {
+		return &tokenExpiredError{fmt.Sprintf("%s has expired at: %d", tv.shortName, payload.Expires)}
+	} else if tv.maxTokenLifetime > 0 && payload.Expires-payload.IssuedAt > int64(tv.maxTokenLifetime/time.Second) {
+		return fmt.Errorf("%s lifetime of %ds exceeds the maximum of %ds", tv.shortName,
+			payload.Expires-payload.IssuedAt, int64(tv.maxTokenLifetime/time.Second))
+	} else if tv.maxAuthAge > 0 && now-payload.AuthTime > int64(tv.maxAuthAge/time.Second) {
+		return fmt.Errorf("%s was authenticated at %d, more than %ds ago", tv.shortName,
+			payload.AuthTime, int64(tv.maxAuthAge/time.Second))
 	}
 	return nil
 }
 
-func (tv *tokenVerifier) verifySignature(ctx context.Context, token string) error {
-	segments := strings.Split(token, ".")
+// verifySignature checks the token signature against the keys of the key source and returns
+// the kid of the key that verified it.
+func (tv *tokenVerifier) verifySignature(ctx context.Context, jwt *parsedJWT, info *VerificationInfo) (string, error) {
+	kid := jwt.header.KeyID
+	if kid == "" && tv.externalKeyID {
+		kid = externalKeyIDFromContext(ctx)
+		if kid == "" {
+			return "", fmt.Errorf("%s has no 'kid' header and no key id was supplied", tv.shortName)
+		}
+	}
 
-	var h jwtHeader
-	if err := decode(segments[0], &h); err != nil {
-		return err
+	var (
+		keys []*PublicKey
+		err  error
+	)
+	if cs, ok := tv.keySource.(cacheInfoSource); ok && info != nil {
+		keys, info.FromCache, info.CacheExpiry, err = cs.keysWithCacheInfo(ctx)
+	} else {
+		keys, err = tv.keySource.Keys(ctx)
+	}
+	if err != nil {
+		return "", &keySourceError{err: err}
+	}
+	if kid != "" && !hasKeyID(keys, kid) {
+		// The token may have been signed with a key published after the cache was filled.
+		if fr, ok := tv.keySource.(forcedRefresher); ok {
+			if refreshed, fromCache, expiry, err := fr.forceRefresh(ctx); err == nil {
+				keys = refreshed
+				if info != nil {
+					info.FromCache, info.CacheExpiry = fromCache, expiry
+				}
+			}
+		}
 	}
 
-	keys, err := tv.keySource.Keys(ctx)
+	signature, err := decodeSegment(jwt.segments[2])
 	if err != nil {
-		return err
+		return "", errBadSignature
 	}
+	digest := signingDigest(jwt.segments)
 
-	verified := false
+	// Try every candidate key rather than only the first one with a matching kid: during key
+	// rotation more than one cached key may carry the same kid, and a token without a kid may
+	// have been signed by any of them.
 	for _, k := range keys {
-		if h.KeyID == "" || h.KeyID == k.Kid {
-			if verifyJWTSignature(segments, k) == nil {
-				verified = true
-				break
+		if kid == "" || kid == k.Kid {
+			if rsa.VerifyPKCS1v15(k.Key, crypto.SHA256, digest, signature) == nil {
+				return k.Kid, nil
 			}
 		}
 	}
-	if !verified {
-		return errors.New("failed to verify token signature")
+	return "", errBadSignature
+}
+
+func (tv *tokenVerifier) isAllowedProject(projectID string) bool {
+	if projectID == tv.projectID {
+		return true
 	}
-	return nil
+	for _, extra := range tv.extraProjectIDs {
+		if projectID == extra {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedProjects describes the acceptable audiences for use in error messages.
+func (tv *tokenVerifier) expectedProjects() string {
+	if len(tv.extraProjectIDs) == 0 {
+		return strconv.Quote(tv.projectID)
+	}
+	return fmt.Sprintf("one of %q", append([]string{tv.projectID}, tv.extraProjectIDs...))
+}
+
+// isAllowedIssuer reports whether issuer is acceptable for a token issued for projectID, which
+// must already have been checked with isAllowedProject.
+func (tv *tokenVerifier) isAllowedIssuer(issuer, projectID string) bool {
+	if tv.emulatorMode && strings.HasPrefix(issuer, "http://") {
+		// The Auth emulator issues tokens under the same issuer but with an http scheme.
+		issuer = "https://" + strings.TrimPrefix(issuer, "http://")
+	}
+	if len(tv.allowedIssuers) == 0 {
+		return issuer == tv.issuerPrefix+projectID
+	}
+	for _, allowed := range tv.allowedIssuers {
+		if issuer == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedIssuers describes the acceptable issuers for use in error messages.
+func (tv *tokenVerifier) expectedIssuers(projectID string) string {
+	if len(tv.allowedIssuers) == 0 {
+		return strconv.Quote(tv.issuerPrefix + projectID)
+	}
+	return fmt.Sprintf("one of %q", tv.allowedIssuers)
+}
+
+// errBadSignature is returned when none of the candidate keys verifies the token signature.
+var errBadSignature = errors.New("failed to verify token signature")
+
+// keySourceError indicates that the public keys needed to verify a signature could not be
+// obtained, as opposed to the signature being invalid.
+type keySourceError struct {
+	err error
+	// invalidContent is set when the token content failed its checks as well, which
+	// SignatureFirst does not report for unsigned tokens.
+	invalidContent bool
+}
+
+func (e *keySourceError) Error() string {
+	return "failed to obtain public keys: " + e.err.Error()
+}
+
+func (e *keySourceError) Unwrap() error {
+	return e.err
+}
+
+func isKeySourceError(err error) bool {
+	var ksErr *keySourceError
+	return errors.As(err, &ksErr)
+}
+
+// canFailOpen reports whether err is only due to the public keys being unavailable, for a
+// token whose content is otherwise valid.
+func canFailOpen(err error) bool {
+	var ksErr *keySourceError
+	return errors.As(err, &ksErr) && !ksErr.invalidContent
+}
+
+// tokenExpiredError indicates a token that is otherwise valid but past its expiry, which
+// clients can fix by refreshing the token rather than signing in again.
+type tokenExpiredError struct {
+	msg string
+}
+
+func (e *tokenExpiredError) Error() string {
+	return e.msg
+}
+
+func isTokenExpired(err error) bool {
+	var expErr *tokenExpiredError
+	return errors.As(err, &expErr)
 }
 
 func (tv *tokenVerifier) getProjectIDMatchMessage() string {
@@ -207,35 +615,127 @@ func (tv *tokenVerifier) getProjectIDMatchMessage() string {
 
 // decode accepts a JWT segment, and decodes it into the given interface.
 func decode(segment string, i interface{}) error {
-	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	decoded, err := decodeSegment(segment)
 	if err != nil {
 		return err
 	}
-	return json.NewDecoder(bytes.NewBuffer(decoded)).Decode(i)
+	return unmarshal(decoded, i)
 }
 
-func verifyJWTSignature(parts []string, k *publicKey) error {
-	content := parts[0] + "." + parts[1]
-	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+// checkDuplicateKeys reports an error if the JSON object in the given JWT segment contains the
+// same top-level key more than once.
+func checkDuplicateKeys(segment string) error {
+	decoded, err := decodeSegment(segment)
 	if err != nil {
 		return err
 	}
+	return checkDuplicateKeysDecoded(decoded)
+}
+
+// checkDuplicateKeysDecoded is like checkDuplicateKeys for an already base64-decoded segment.
+// encoding/json silently keeps the last of several duplicate keys, so the object is scanned
+// token by token instead.
+func checkDuplicateKeysDecoded(decoded []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(decoded))
+	if t, err := dec.Token(); err != nil {
+		return err
+	} else if t != json.Delim('{') {
+		return errors.New("expected a JSON object")
+	}
+
+	seen := make(map[string]bool)
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return errors.New("expected a JSON object key")
+		}
+		if seen[key] {
+			return fmt.Errorf("duplicate key %q", key)
+		}
+		seen[key] = true
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unmarshal decodes an already base64-decoded JWT segment into the given interface.
+func unmarshal(decoded []byte, i interface{}) error {
+	return json.NewDecoder(bytes.NewBuffer(decoded)).Decode(i)
+}
+
+// decodeSegment base64-decodes a JWT segment. Compliant tokens use unpadded URL-safe encoding,
+// but some clients pad their segments or use the standard alphabet, so those encodings are
+// tried in turn before giving up. The signature is still computed over the segments as they
+// appear in the token, so this leniency does not affect what is verified.
+func decodeSegment(segment string) ([]byte, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err == nil {
+		return decoded, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.URLEncoding, base64.RawStdEncoding, base64.StdEncoding} {
+		if d, e := enc.DecodeString(segment); e == nil {
+			return d, nil
+		}
+	}
+	return nil, err
+}
 
+// signingDigest returns the SHA-256 digest of the signed part of a JWT, its header and payload
+// segments as they appear in the token.
+func signingDigest(parts []string) []byte {
 	h := sha256.New()
-	h.Write([]byte(content))
-	return rsa.VerifyPKCS1v15(k.Key, crypto.SHA256, h.Sum(nil), []byte(signature))
+	h.Write([]byte(parts[0]))
+	h.Write([]byte{'.'})
+	h.Write([]byte(parts[1]))
+	return h.Sum(nil)
 }
 
-// publicKey represents a parsed RSA public key along with its unique key ID.
-type publicKey struct {
+// PublicKey represents a parsed RSA public key along with its unique key ID.
+type PublicKey struct {
 	Kid string
 	Key *rsa.PublicKey
 }
 
-// keySource is used to obtain a set of public keys, which can be used to verify cryptographic
+// KeySource is used to obtain a set of public keys, which can be used to verify cryptographic
 // signatures.
-type keySource interface {
-	Keys(context.Context) ([]*publicKey, error)
+type KeySource interface {
+	Keys(context.Context) ([]*PublicKey, error)
+}
+
+// staticKeySource serves a fixed set of public keys, e.g. for tests or offline verification.
+type staticKeySource struct {
+	keys []*PublicKey
+}
+
+// NewStaticKeySource returns a KeySource that always serves the given keys and never issues
+// network requests.
+func NewStaticKeySource(keys []*PublicKey) KeySource {
+	return &staticKeySource{keys: append([]*PublicKey(nil), keys...)}
+}
+
+// Keys returns the keys the source was created with.
+func (k *staticKeySource) Keys(ctx context.Context) ([]*PublicKey, error) {
+	return k.keys, nil
+}
+
+// cacheInfoSource is implemented by key sources that cache keys and can report the state of
+// their cache alongside the keys.
+type cacheInfoSource interface {
+	keysWithCacheInfo(context.Context) ([]*PublicKey, bool, time.Time, error)
+}
+
+// forcedRefresher is implemented by key sources that can refresh their keys before the cache
+// expires, e.g. when a token refers to an unknown kid.
+type forcedRefresher interface {
+	forceRefresh(context.Context) ([]*PublicKey, bool, time.Time, error)
 }
 
 // httpKeySource fetches RSA public keys from a remote HTTP server, and caches them in
@@ -244,31 +744,104 @@ type keySource interface {
 type httpKeySource struct {
 	KeyURI     string
 	HTTPClient *http.Client
-	CachedKeys []*publicKey
+	CachedKeys []*PublicKey
 	ExpiryTime time.Time
 	Mutex      *sync.Mutex
+
+	refreshes   int
+	fetchErrors int
+	// parsedKeys caches the keys parsed during the last refresh by a hash of their kid and
+	// certificate, so that unchanged certificates are not parsed again.
+	parsedKeys map[[sha256.Size]byte]*PublicKey
+	// minForcedRefreshInterval is the minimum time between two forced refreshes, so that tokens
+	// with made-up kids cannot turn the key source into a request amplifier.
+	minForcedRefreshInterval time.Duration
+	lastForcedRefresh        time.Time
+	// etag is the entity tag of the last successful response, sent back as If-None-Match so
+	// that unchanged keys are answered with 304 Not Modified.
+	etag string
+}
+
+// KeyCacheStats is a snapshot of the state of a public key cache.
+type KeyCacheStats struct {
+	// CachedKeys is the number of keys currently cached.
+	CachedKeys int
+	// ExpiryTime is the time at which the cached keys expire.
+	ExpiryTime time.Time
+	// Refreshes is the number of times keys were fetched from the remote server.
+	Refreshes int
+	// FetchErrors is the number of refreshes that failed.
+	FetchErrors int
 }
 
 func newHTTPKeySource(uri string, hc *http.Client) *httpKeySource {
 	return &httpKeySource{
-		KeyURI:     uri,
-		HTTPClient: hc,
-		Mutex:      &sync.Mutex{},
+		KeyURI:                   uri,
+		HTTPClient:               hc,
+		Mutex:                    &sync.Mutex{},
+		minForcedRefreshInterval: forcedRefreshInterval,
 	}
 }
 
 // Keys returns the RSA Public Keys hosted at this key source's URI. Refreshes the data if
 // the cache is stale.
-func (k *httpKeySource) Keys(ctx context.Context) ([]*publicKey, error) {
+func (k *httpKeySource) Keys(ctx context.Context) ([]*PublicKey, error) {
+	keys, _, _, err := k.keysWithCacheInfo(ctx)
+	return keys, err
+}
+
+// keysWithCacheInfo returns the same keys as Keys, along with whether they were served from
+// the cache and when the cache expires.
+func (k *httpKeySource) keysWithCacheInfo(ctx context.Context) ([]*PublicKey, bool, time.Time, error) {
 	k.Mutex.Lock()
 	defer k.Mutex.Unlock()
+	fromCache := true
 	if len(k.CachedKeys) == 0 || k.hasExpired() {
+		fromCache = false
+		k.refreshes++
 		err := k.refreshKeys(ctx)
+		if err != nil {
+			k.fetchErrors++
+		}
 		if err != nil && len(k.CachedKeys) == 0 {
-			return nil, err
+			return nil, false, k.ExpiryTime, err
 		}
 	}
-	return k.CachedKeys, nil
+	return k.CachedKeys, fromCache, k.ExpiryTime, nil
+}
+
+// forceRefresh fetches the keys even if the cache has not expired, at most once every
+// minForcedRefreshInterval. When rate limited, or if the refresh fails, the cached keys are
+// returned unchanged. Like keysWithCacheInfo, it also reports whether the keys came from the
+// cache and when the cache expires.
+func (k *httpKeySource) forceRefresh(ctx context.Context) ([]*PublicKey, bool, time.Time, error) {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	if time.Since(k.lastForcedRefresh) < k.minForcedRefreshInterval {
+		return k.CachedKeys, true, k.ExpiryTime, nil
+	}
+	k.lastForcedRefresh = time.Now()
+
+	cachedKeys := k.CachedKeys
+	k.refreshes++
+	if err := k.refreshKeys(ctx); err != nil {
+		k.fetchErrors++
+		k.CachedKeys = cachedKeys
+		return cachedKeys, true, k.ExpiryTime, err
+	}
+	return k.CachedKeys, false, k.ExpiryTime, nil
+}
+
+// Stats returns a snapshot of the key cache.
+func (k *httpKeySource) Stats() KeyCacheStats {
+	k.Mutex.Lock()
+	defer k.Mutex.Unlock()
+	return KeyCacheStats{
+		CachedKeys:  len(k.CachedKeys),
+		ExpiryTime:  k.ExpiryTime,
+		Refreshes:   k.refreshes,
+		FetchErrors: k.fetchErrors,
+	}
 }
 
 // hasExpired indicates whether the cache has expired.
@@ -277,11 +850,15 @@ func (k *httpKeySource) hasExpired() bool {
 }
 
 func (k *httpKeySource) refreshKeys(ctx context.Context) error {
+	cachedKeys := k.CachedKeys
 	k.CachedKeys = nil
 	req, err := http.NewRequest("GET", k.KeyURI, nil)
 	if err != nil {
 		return err
 	}
+	if k.etag != "" && len(cachedKeys) > 0 {
+		req.Header.Set("If-None-Match", k.etag)
+	}
 
 	resp, err := k.HTTPClient.Do(req.WithContext(ctx))
 	if err != nil {
@@ -289,7 +866,30 @@ func (k *httpKeySource) refreshKeys(ctx context.Context) error {
 	}
 	defer resp.Body.Close()
 
-	contents, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotModified && len(cachedKeys) > 0 {
+		// The keys have not changed; only their freshness needs extending.
+		maxAge, err := findMaxAge(resp)
+		if err != nil {
+			return err
+		}
+		k.CachedKeys = cachedKeys
+		k.ExpiryTime = time.Now().Add(*maxAge)
+		return nil
+	}
+
+	body := io.Reader(resp.Body)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		// The transport only decompresses responses to requests it compressed itself, which is
+		// not the case when a proxy adds the encoding.
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	contents, err := ioutil.ReadAll(body)
 	if err != nil {
 		return err
 	}
@@ -297,7 +897,7 @@ func (k *httpKeySource) refreshKeys(ctx context.Context) error {
 		return fmt.Errorf("invalid response (%d) while retrieving public keys: %s",
 			resp.StatusCode, string(contents))
 	}
-	newKeys, err := parsePublicKeys(contents)
+	newKeys, parsedKeys, err := parsePublicKeysCached(contents, k.parsedKeys)
 	if err != nil {
 		return err
 	}
@@ -305,43 +905,78 @@ func (k *httpKeySource) refreshKeys(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	k.CachedKeys = append([]*publicKey(nil), newKeys...)
+	k.CachedKeys = append([]*PublicKey(nil), newKeys...)
+	k.parsedKeys = parsedKeys
+	k.etag = resp.Header.Get("ETag")
 	k.ExpiryTime = time.Now().Add(*maxAge)
 	return nil
 }
 
-func parsePublicKeys(keys []byte) ([]*publicKey, error) {
+func parsePublicKeys(keys []byte) ([]*PublicKey, error) {
+	result, _, err := parsePublicKeysCached(keys, nil)
+	return result, err
+}
+
+// parsePublicKeysCached is like parsePublicKeys, but reuses the keys in cache whose kid and
+// certificate are unchanged. The keys are returned sorted by kid, along with a new cache holding
+// exactly the keys parsed from keys, so entries that are no longer served are evicted.
+func parsePublicKeysCached(keys []byte, cache map[[sha256.Size]byte]*PublicKey) ([]*PublicKey, map[[sha256.Size]byte]*PublicKey, error) {
 	m := make(map[string]string)
 	err := json.Unmarshal(keys, &m)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var result []*publicKey
+	var result []*PublicKey
+	parsed := make(map[[sha256.Size]byte]*PublicKey, len(m))
 	for kid, key := range m {
-		pubKey, err := parsePublicKey(kid, []byte(key))
-		if err != nil {
-			return nil, err
+		hash := sha256.Sum256([]byte(kid + "\x00" + key))
+		pubKey, ok := cache[hash]
+		if !ok {
+			pubKey, err = parsePublicKey(kid, []byte(key))
+			if err != nil {
+				return nil, nil, err
+			}
 		}
+		parsed[hash] = pubKey
 		result = append(result, pubKey)
 	}
-	return result, nil
+	sortKeys(result)
+	return result, parsed, nil
 }
 
-func parsePublicKey(kid string, key []byte) (*publicKey, error) {
+// sortKeys orders keys by kid, so that the order in which signature verification tries them
+// does not depend on map iteration.
+func sortKeys(keys []*PublicKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Kid < keys[j].Kid
+	})
+}
+
+func parsePublicKey(kid string, key []byte) (*PublicKey, error) {
 	block, _ := pem.Decode(key)
 	if block == nil {
 		return nil, errors.New("failed to decode the certificate as PEM")
 	}
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return nil, err
+	var parsed interface{}
+	if block.Type == "PUBLIC KEY" {
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		parsed = pub
+	} else {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		parsed = cert.PublicKey
 	}
-	pk, ok := cert.PublicKey.(*rsa.PublicKey)
+	pk, ok := parsed.(*rsa.PublicKey)
 	if !ok {
 		return nil, errors.New("certificate is not an RSA key")
 	}
-	return &publicKey{kid, pk}, nil
+	return &PublicKey{kid, pk}, nil
 }
 
 func findMaxAge(resp *http.Response) (*time.Duration, error) {
@@ -0,0 +1,1211 @@
+package firebase_verify_token
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPlugin creates the plugin for cfg, failing the test if cfg is invalid.
+func newTestPlugin(t testing.TB, cfg *Config) *FirebaseJwtPlugin {
+	t.Helper()
+	h, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.(*FirebaseJwtPlugin)
+}
+
+func TestAllowedIssuers(t *testing.T) {
+	const tenantIssuer = "https://securetoken.google.com/proj-1/tenants/tenant-a"
+	tests := []struct {
+		name    string
+		allowed []string
+		issuer  string
+		wantErr bool
+	}{
+		{"default issuer", nil, idTokenIssuerPrefix + testProjectID, false},
+		{"tenant issuer without allow-list", nil, tenantIssuer, true},
+		{"tenant issuer allowed", []string{tenantIssuer}, tenantIssuer, false},
+		{"one of several", []string{"https://issuer.example.com", tenantIssuer}, tenantIssuer, false},
+		{"allow-list replaces default", []string{tenantIssuer}, idTokenIssuerPrefix + testProjectID, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.AllowedIssuers = tt.allowed
+			plugin := newTestPlugin(t, cfg)
+
+			token := mintTestToken(t, map[string]interface{}{"iss": tt.issuer})
+			_, err := plugin.VerifyIDToken(context.Background(), token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "same Firebase project") {
+				t.Errorf("error %q lacks the project mismatch guidance", err)
+			}
+		})
+	}
+}
+
+func TestDecodeSegment(t *testing.T) {
+	data := []byte{0xfb, 0xff, 0xbf, 'a'}
+	tests := []struct {
+		name    string
+		segment string
+	}{
+		{"raw url", base64.RawURLEncoding.EncodeToString(data)},
+		{"padded url", base64.URLEncoding.EncodeToString(data)},
+		{"raw standard", base64.RawStdEncoding.EncodeToString(data)},
+		{"padded standard", base64.StdEncoding.EncodeToString(data)},
+	}
+	for _, tt := range tests {
+		got, err := decodeSegment(tt.segment)
+		if err != nil || string(got) != string(data) {
+			t.Errorf("%s: decodeSegment(%q) = %x, %v; want %x", tt.name, tt.segment, got, err, data)
+		}
+	}
+	if _, err := decodeSegment("not base64!"); err == nil {
+		t.Error("decodeSegment accepted invalid input")
+	}
+}
+
+// signWithEncoding builds an ID token with the given JSON header and payload whose segments
+// use enc, signing the encoded segments as they appear in the token.
+func signWithEncoding(t *testing.T, enc *base64.Encoding, header, payload []byte) string {
+	t.Helper()
+	content := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(content))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, testKey, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content + "." + enc.EncodeToString(signature)
+}
+
+func TestVerifyPaddedAndStandardEncodings(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss": idTokenIssuerPrefix + testProjectID,
+		"aud": testProjectID,
+		"sub": "user-1",
+		"iat": now,
+		"exp": now + 3600,
+		// Make the payload length not a multiple of 3 so the padded encodings add padding.
+		"pad": "x",
+	}
+	for len(mustMarshal(t, claims))%3 == 0 {
+		claims["pad"] = claims["pad"].(string) + "x"
+	}
+
+	for _, enc := range []*base64.Encoding{base64.URLEncoding, base64.StdEncoding, base64.RawStdEncoding} {
+		token := signWithEncoding(t, enc, testHeader(t), mustMarshal(t, claims))
+		if enc == base64.URLEncoding && !strings.Contains(token, "=") {
+			t.Fatalf("token %q is not padded", token)
+		}
+		if _, err := plugin.VerifyIDToken(context.Background(), token); err != nil {
+			t.Errorf("VerifyIDToken(%q) error = %v", token, err)
+		}
+
+		// The lenient decoding must not let a modified payload through.
+		forged := make(map[string]interface{}, len(claims))
+		for name, value := range claims {
+			forged[name] = value
+		}
+		forged["sub"] = "admin"
+		parts := strings.Split(token, ".")
+		parts[1] = enc.EncodeToString(mustMarshal(t, forged))
+		if _, err := plugin.VerifyIDToken(context.Background(), strings.Join(parts, ".")); err == nil {
+			t.Error("VerifyIDToken accepted a tampered token")
+		}
+	}
+}
+
+// testHeader returns the JSON header of a token signed with testKey.
+func testHeader(t *testing.T) []byte {
+	return mustMarshal(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": testKeyID})
+}
+
+func mustMarshal(t testing.TB, v interface{}) []byte {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// publicKeyPEM returns key PEM-encoded, as served by a key endpoint.
+func publicKeyPEM(t testing.TB, key *rsa.PublicKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestHTTPKeySourceStats(t *testing.T) {
+	keys := mustMarshal(t, map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)})
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if failing {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Cache-Control", "public, max-age=3600")
+		rw.Write(keys)
+	}))
+	defer server.Close()
+
+	ks := newHTTPKeySource(server.URL, server.Client())
+	ks.minForcedRefreshInterval = 0
+	if stats := ks.Stats(); stats != (KeyCacheStats{}) {
+		t.Errorf("Stats() before any fetch = %+v, want zero", stats)
+	}
+
+	if _, err := ks.Keys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	stats := ks.Stats()
+	if stats.CachedKeys != 1 || stats.Refreshes != 1 || stats.FetchErrors != 0 {
+		t.Errorf("Stats() after first fetch = %+v", stats)
+	}
+	if d := time.Until(stats.ExpiryTime); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("ExpiryTime is %v away, want about an hour", d)
+	}
+
+	// Cached keys are served without a refresh.
+	if _, err := ks.Keys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := ks.Stats().Refreshes; got != 1 {
+		t.Errorf("Refreshes = %d after a cached read, want 1", got)
+	}
+
+	if _, _, _, err := ks.forceRefresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	failing = true
+	if _, _, _, err := ks.forceRefresh(context.Background()); err == nil {
+		t.Fatal("forceRefresh succeeded against a failing server")
+	}
+	stats = ks.Stats()
+	if stats.CachedKeys != 1 || stats.Refreshes != 3 || stats.FetchErrors != 1 {
+		t.Errorf("Stats() after forced refreshes = %+v, want 1 key, 3 refreshes, 1 error", stats)
+	}
+}
+
+// TestIntrospectAfterForcedRefresh checks that a token whose key only arrived with a forced
+// refresh is reported as verified with freshly fetched keys.
+func TestIntrospectAfterForcedRefresh(t *testing.T) {
+	kid := "k0"
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		maxAge := 60
+		if kid == testKeyID {
+			maxAge = 3600
+		}
+		rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		rw.Write(mustMarshal(t, map[string]string{kid: publicKeyPEM(t, &testKey.PublicKey)}))
+	}))
+	defer server.Close()
+
+	ks := newHTTPKeySource(server.URL, server.Client())
+	ks.minForcedRefreshInterval = 0
+	if _, err := ks.Keys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	kid = testKeyID
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = ks
+	tv := newTestPlugin(t, cfg).current().verifier
+	_, info, err := tv.Introspect(context.Background(), mintTestToken(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.KeyID != testKeyID {
+		t.Errorf("KeyID = %q, want %q", info.KeyID, testKeyID)
+	}
+	if info.FromCache {
+		t.Error("FromCache = true for a key that was only just fetched")
+	}
+	if d := time.Until(info.CacheExpiry); d < 59*time.Minute {
+		t.Errorf("CacheExpiry is %v away, want that of the refreshed keys, about an hour", d)
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetches++
+		rw.Header().Set("Cache-Control", "public, max-age=3600")
+		rw.Write(mustMarshal(t, map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)}))
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = newHTTPKeySource(server.URL, server.Client())
+	plugin := newTestPlugin(t, cfg)
+	token := mintTestToken(t, nil)
+
+	// A cold cache fetches the keys.
+	verified, info, err := plugin.Introspect(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.UID != "user-1" {
+		t.Errorf("UID = %q, want %q", verified.UID, "user-1")
+	}
+	if info.KeyID != testKeyID || info.FromCache || fetches != 1 {
+		t.Errorf("cold cache: KeyID = %q, FromCache = %v after %d fetches, want %q, false, 1", info.KeyID, info.FromCache, fetches, testKeyID)
+	}
+	if d := time.Until(info.CacheExpiry); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("CacheExpiry is %v away, want about an hour", d)
+	}
+	if info.Elapsed <= 0 {
+		t.Errorf("Elapsed = %v, want it measured", info.Elapsed)
+	}
+	expiry := info.CacheExpiry
+
+	// The next verification is served from the cache.
+	if _, info, err = plugin.Introspect(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+	if info.KeyID != testKeyID || !info.FromCache || fetches != 1 {
+		t.Errorf("cached read: KeyID = %q, FromCache = %v after %d fetches, want %q, true, 1", info.KeyID, info.FromCache, fetches, testKeyID)
+	}
+	if !info.CacheExpiry.Equal(expiry) {
+		t.Errorf("CacheExpiry = %v on a cached read, want %v", info.CacheExpiry, expiry)
+	}
+
+	// Info is filled in as far as verification got.
+	verified, info, err = plugin.Introspect(context.Background(), mintTestToken(t, map[string]interface{}{"aud": "other-project"}))
+	if err == nil || verified != nil {
+		t.Fatalf("Introspect() = %+v, %v for a token of another project", verified, err)
+	}
+	if info.KeyID != "" || info.Elapsed <= 0 {
+		t.Errorf("failed verification: KeyID = %q, Elapsed = %v, want no key and a measured time", info.KeyID, info.Elapsed)
+	}
+}
+
+func TestPluginStats(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	if stats := newTestPlugin(t, cfg).Stats(); stats != (Stats{}) {
+		t.Errorf("Stats() before any request = %+v, want zero", stats)
+	}
+
+	// Static key sources have no cache to report on.
+	cfg.KeySource = testKeySource()
+	if stats := newTestPlugin(t, cfg).Stats(); stats != (Stats{}) {
+		t.Errorf("Stats() with a static key source = %+v, want zero", stats)
+	}
+}
+
+// TestMissingKeyID checks that tokens without a 'kid' header are rejected whichever check
+// runs first; Firebase ID tokens always carry one.
+func TestMissingKeyID(t *testing.T) {
+	now := time.Now().Unix()
+	noKid, err := MintToken(testKey, "", map[string]interface{}{
+		"iss":      idTokenIssuerPrefix + testProjectID,
+		"aud":      testProjectID,
+		"sub":      "user-1",
+		"iat":      now,
+		"exp":      now + 3600,
+		"firebase": map[string]interface{}{"sign_in_provider": "password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signatureFirst := range []bool{false, true} {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.KeySource = testKeySource()
+		cfg.SignatureFirst = signatureFirst
+		if _, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), noKid); err == nil {
+			t.Errorf("SignatureFirst=%v: token without a kid was accepted", signatureFirst)
+		}
+	}
+}
+
+func TestNotBefore(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		nbf     interface{}
+		wantErr bool
+	}{
+		{"absent", nil, false},
+		{"in the past", now - 60, false},
+		{"within skew", now + 200, false},
+		{"not yet valid", now + 600, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := mintTestToken(t, map[string]interface{}{"nbf": tt.nbf})
+			got, err := plugin.VerifyIDToken(context.Background(), token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tt.nbf != nil && got.NotBefore != tt.nbf {
+				t.Errorf("NotBefore = %d, want %d", got.NotBefore, tt.nbf)
+			}
+		})
+	}
+}
+
+func TestMaxSubjectLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		subject string
+		wantErr bool
+	}{
+		{"default at limit", maxSubjectLength, strings.Repeat("u", 128), false},
+		{"default over limit", maxSubjectLength, strings.Repeat("u", 129), true},
+		{"zero means the default", 0, strings.Repeat("u", 129), true},
+		{"zero means the default, at limit", 0, strings.Repeat("u", 128), false},
+		{"custom limit", 16, strings.Repeat("u", 17), true},
+		{"disabled", -1, strings.Repeat("u", 1024), false},
+		{"empty subject", maxSubjectLength, "", true},
+		{"empty subject, disabled", -1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.MaxSubjectLength = tt.max
+			plugin := newTestPlugin(t, cfg)
+
+			token := mintTestToken(t, map[string]interface{}{"sub": tt.subject})
+			if _, err := plugin.VerifyIDToken(context.Background(), token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestMaxSubjectLengthWithoutCreateConfig checks that a Config built by hand keeps the Firebase
+// UID limit.
+func TestMaxSubjectLengthWithoutCreateConfig(t *testing.T) {
+	plugin := newTestPlugin(t, &Config{ProjectID: testProjectID, KeySource: testKeySource()})
+	token := mintTestToken(t, map[string]interface{}{"sub": strings.Repeat("u", 500)})
+	if _, err := plugin.VerifyIDToken(context.Background(), token); err == nil {
+		t.Error("VerifyIDToken accepted a 500-character subject")
+	}
+}
+
+func TestPayloadClaimTypes(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+
+	token, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, map[string]interface{}{
+		"role":     "admin",
+		"firebase": map[string]interface{}{"sign_in_provider": "google.com", "tenant": "t1", "identities": map[string]interface{}{"email": []string{"a@example.com"}}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Firebase.SignInProvider != "google.com" || token.Firebase.Tenant != "t1" || token.Firebase.Identities["email"] == nil {
+		t.Errorf("Firebase = %+v", token.Firebase)
+	}
+	if token.Subject != "user-1" || token.UID != "user-1" || token.Expires == 0 || token.AuthTime == 0 {
+		t.Errorf("token = %+v", token)
+	}
+	for _, name := range []string{"iss", "aud", "exp", "iat", "sub"} {
+		if _, ok := token.Claims[name]; ok {
+			t.Errorf("Claims holds the standard claim %q", name)
+		}
+	}
+	for _, name := range []string{"role", "auth_time", "firebase"} {
+		if _, ok := token.Claims[name]; !ok {
+			t.Errorf("Claims lacks %q", name)
+		}
+	}
+
+	for name, value := range map[string]interface{}{
+		"exp":       "tomorrow",
+		"iat":       1.5,
+		"auth_time": true,
+		"aud":       []string{testProjectID},
+		"sub":       42,
+		"firebase":  "password",
+	} {
+		_, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, map[string]interface{}{name: value}))
+		if err == nil {
+			t.Errorf("VerifyIDToken accepted %s = %v", name, value)
+		}
+	}
+}
+
+func BenchmarkVerifyToken(b *testing.B) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	tv := newTestPlugin(b, cfg).current().verifier
+	token := mintTestToken(b, nil)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tv.VerifyToken(ctx, token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVerifyTriesEveryMatchingKey(t *testing.T) {
+	rotated := &PublicKey{Kid: testKeyID, Key: &mustGenerateKey().PublicKey}
+	current := &PublicKey{Kid: testKeyID, Key: &testKey.PublicKey}
+	unrelated := &PublicKey{Kid: "k2", Key: &testKey.PublicKey}
+	tests := []struct {
+		name    string
+		keys    []*PublicKey
+		wantErr bool
+	}{
+		{"second key verifies", []*PublicKey{rotated, current}, false},
+		{"first key verifies", []*PublicKey{current, rotated}, false},
+		{"no matching key verifies", []*PublicKey{rotated, unrelated}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = NewStaticKeySource(tt.keys)
+			plugin := newTestPlugin(t, cfg)
+
+			_, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, nil))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStrictJSON(t *testing.T) {
+	now := time.Now().Unix()
+	claims := fmt.Sprintf(`"iss":%q,"aud":%q,"iat":%d,"exp":%d`,
+		idTokenIssuerPrefix+testProjectID, testProjectID, now, now+3600)
+	header := testHeader(t)
+	tests := []struct {
+		name      string
+		header    []byte
+		payload   string
+		strictErr bool
+	}{
+		{"unique keys", header, `{"sub":"user-1",` + claims + `}`, false},
+		{"duplicate sub", header, `{"sub":"admin",` + claims + `,"sub":"user-1"}`, true},
+		{"same key at different levels", header, `{"sub":"user-1","firebase":{"tenant":"a"},"extra":{"a":1,"b":{"a":2}},` + claims + `}`, false},
+		{"duplicate nested key, only top-level keys are checked", header, `{"sub":"user-1","extra":{"a":1,"a":2},` + claims + `}`, false},
+		{"duplicate header key", []byte(`{"alg":"none","alg":"RS256","typ":"JWT","kid":"` + testKeyID + `"}`), `{"sub":"user-1",` + claims + `}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signWithEncoding(t, base64.RawURLEncoding, tt.header, []byte(tt.payload))
+			for _, strict := range []bool{false, true} {
+				cfg := CreateConfig()
+				cfg.ProjectID = testProjectID
+				cfg.KeySource = testKeySource()
+				cfg.StrictJSON = strict
+				_, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), token)
+				if wantErr := strict && tt.strictErr; (err != nil) != wantErr {
+					t.Errorf("StrictJSON=%v: VerifyIDToken() error = %v, wantErr %v", strict, err, wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestIssuedAtBoundary(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.FutureSkew = "10s"
+	plugin := newTestPlugin(t, cfg)
+
+	tests := []struct {
+		name    string
+		offset  int64
+		wantErr bool
+	}{
+		{"iat == now", 0, false},
+		{"iat == now+skew", 10, false},
+		{"iat == now+skew+1", 11, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Timestamps have second granularity, so retry if the clock ticks over mid-check.
+			for attempt := 0; attempt < 3; attempt++ {
+				now := time.Now().Unix()
+				token := mintTestToken(t, map[string]interface{}{"iat": now + tt.offset, "auth_time": now})
+				_, err := plugin.VerifyIDToken(context.Background(), token)
+				if time.Now().Unix() != now {
+					continue
+				}
+				if (err != nil) != tt.wantErr {
+					t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				return
+			}
+			t.Skip("clock kept ticking over during the check")
+		})
+	}
+}
+
+func TestRequireFirebaseClaim(t *testing.T) {
+	tests := []struct {
+		name     string
+		firebase interface{}
+		require  bool
+		wantErr  bool
+	}{
+		{"firebase block, optional", map[string]interface{}{"sign_in_provider": "password"}, false, false},
+		{"firebase block, required", map[string]interface{}{"sign_in_provider": "password"}, true, false},
+		{"no firebase block, optional", nil, false, false},
+		{"no firebase block, required", nil, true, true},
+		{"no provider, required", map[string]interface{}{"tenant": "tenant-a"}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.RequireFirebaseClaim = tt.require
+			token := mintTestToken(t, map[string]interface{}{"firebase": tt.firebase})
+			if _, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignatureFirst(t *testing.T) {
+	forgedKey := mustGenerateKey()
+	mintForged := func(claims map[string]interface{}) string {
+		now := time.Now().Unix()
+		all := map[string]interface{}{
+			"iss": idTokenIssuerPrefix + testProjectID,
+			"aud": testProjectID,
+			"sub": "user-1",
+			"iat": now,
+			"exp": now + 3600,
+		}
+		for name, value := range claims {
+			all[name] = value
+		}
+		token, err := MintToken(forgedKey, testKeyID, all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	const (
+		wantOK              = ""
+		wantBadSignature    = "bad signature"
+		wantKeysUnavailable = "keys unavailable"
+		wantAudience        = "audience"
+	)
+	tests := []struct {
+		name           string
+		signatureFirst bool
+		keys           KeySource
+		token          string
+		want           string
+		wantFailOpen   bool
+	}{
+		{"valid", true, testKeySource(), mintTestToken(t, nil), wantOK, false},
+		{"forged audience", true, testKeySource(), mintForged(map[string]interface{}{"aud": "other-project"}), wantBadSignature, false},
+		{"forged audience, content first", false, testKeySource(), mintForged(map[string]interface{}{"aud": "other-project"}), wantAudience, false},
+		{"outage, valid content", true, unavailableKeySource{}, mintTestToken(t, nil), wantKeysUnavailable, true},
+		{"outage, wrong audience", true, unavailableKeySource{}, mintForged(map[string]interface{}{"aud": "other-project"}), wantKeysUnavailable, false},
+		{"outage, expired", true, unavailableKeySource{}, mintTestToken(t, map[string]interface{}{"exp": time.Now().Unix() - 3600}), wantKeysUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = tt.keys
+			cfg.SignatureFirst = tt.signatureFirst
+			_, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), tt.token)
+
+			switch tt.want {
+			case wantOK:
+				if err != nil {
+					t.Fatalf("VerifyIDToken() error = %v", err)
+				}
+				return
+			case wantBadSignature:
+				if err != errBadSignature {
+					t.Fatalf("VerifyIDToken() error = %v, want %v", err, errBadSignature)
+				}
+			case wantKeysUnavailable:
+				if !isKeySourceError(err) {
+					t.Fatalf("VerifyIDToken() error = %v, want a key source error", err)
+				}
+			case wantAudience:
+				if err == nil || !strings.Contains(err.Error(), "other-project") {
+					t.Fatalf("VerifyIDToken() error = %v, want the audience error", err)
+				}
+			}
+			if tt.signatureFirst && (strings.Contains(err.Error(), testProjectID) || strings.Contains(err.Error(), "other-project")) {
+				t.Errorf("VerifyIDToken() error %q discloses the expected or actual audience", err)
+			}
+			if got := canFailOpen(err); got != tt.wantFailOpen {
+				t.Errorf("canFailOpen(%v) = %v, want %v", err, got, tt.wantFailOpen)
+			}
+		})
+	}
+}
+
+func TestSkipCustomTokenCheck(t *testing.T) {
+	now := time.Now().Unix()
+	customToken, err := MintToken(testKey, "", map[string]interface{}{
+		"iss": "firebase-adminsdk@proj-1.iam.gserviceaccount.com",
+		"aud": firebaseAudience,
+		"sub": "user-1",
+		"uid": "user-1",
+		"iat": now,
+		"exp": now + 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.KeySource = testKeySource()
+		cfg.SkipCustomTokenCheck = skip
+		_, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), customToken)
+		if err == nil {
+			t.Fatalf("SkipCustomTokenCheck=%v: VerifyIDToken accepted a custom token", skip)
+		}
+		// The custom token message is replaced by the regular kid check.
+		if custom := strings.Contains(err.Error(), "custom token"); custom == skip {
+			t.Errorf("SkipCustomTokenCheck=%v: VerifyIDToken() error = %v", skip, err)
+		}
+		if kid := strings.Contains(err.Error(), "'kid'"); kid != skip {
+			t.Errorf("SkipCustomTokenCheck=%v: VerifyIDToken() error = %v", skip, err)
+		}
+	}
+}
+
+// certificatePEM returns a self-signed certificate for key, in the form Google serves its
+// public keys.
+func certificatePEM(t testing.TB, key *rsa.PrivateKey) string {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "securetoken.system.gserviceaccount.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestRefreshReusesAndEvictsParsedKeys(t *testing.T) {
+	certs := map[string]string{
+		"k1": certificatePEM(t, testKey),
+		"k2": certificatePEM(t, testKey),
+		"k3": certificatePEM(t, testKey),
+	}
+	served := []string{"k1", "k2"}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		keys := make(map[string]string)
+		for _, kid := range served {
+			keys[kid] = certs[kid]
+		}
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Write(mustMarshal(t, keys))
+	}))
+	defer server.Close()
+
+	ks := newHTTPKeySource(server.URL, server.Client())
+	if err := ks.refreshKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	first := make(map[string]*PublicKey)
+	for _, k := range ks.CachedKeys {
+		first[k.Kid] = k
+	}
+
+	served = []string{"k2", "k3"}
+	if err := ks.refreshKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	for _, k := range ks.CachedKeys {
+		kids = append(kids, k.Kid)
+	}
+	if strings.Join(kids, ",") != "k2,k3" {
+		t.Fatalf("cached kids = %v, want [k2 k3]", kids)
+	}
+	if ks.CachedKeys[0] != first["k2"] {
+		t.Error("the unchanged k2 certificate was parsed again")
+	}
+	if len(ks.parsedKeys) != 2 {
+		t.Errorf("parse cache holds %d keys, want 2", len(ks.parsedKeys))
+	}
+	for _, k := range ks.parsedKeys {
+		if k == first["k1"] {
+			t.Error("k1 is no longer served but still in the parse cache")
+		}
+	}
+
+	// A certificate replaced under the same kid is parsed again.
+	certs["k3"] = certificatePEM(t, mustGenerateKey())
+	previous := ks.CachedKeys[1]
+	if err := ks.refreshKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ks.CachedKeys[1] == previous || ks.CachedKeys[1].Key.Equal(previous.Key) {
+		t.Error("the replaced k3 certificate was not parsed again")
+	}
+}
+
+func BenchmarkRefreshKeys(b *testing.B) {
+	keys := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		keys[fmt.Sprintf("k%d", i)] = certificatePEM(b, testKey)
+	}
+	body := mustMarshal(b, keys)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Write(body)
+	}))
+	defer server.Close()
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%v", cached), func(b *testing.B) {
+			ks := newHTTPKeySource(server.URL, server.Client())
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					ks.parsedKeys = nil
+				}
+				if err := ks.refreshKeys(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshKeysNotModified(t *testing.T) {
+	keys := mustMarshal(t, map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)})
+	var requests, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", 600*requests))
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", `"v1"`)
+		rw.Write(keys)
+	}))
+	defer server.Close()
+
+	ks := newHTTPKeySource(server.URL, server.Client())
+	if err := ks.refreshKeys(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	cached := ks.CachedKeys
+	expiry := ks.ExpiryTime
+
+	if err := ks.refreshKeys(context.Background()); err != nil {
+		t.Fatalf("refreshKeys() after 304 error = %v", err)
+	}
+	if notModified != 1 {
+		t.Fatalf("server answered %d requests with 304, want 1", notModified)
+	}
+	if len(ks.CachedKeys) != 1 || ks.CachedKeys[0] != cached[0] {
+		t.Errorf("cached keys after 304 = %v, want %v", ks.CachedKeys, cached)
+	}
+	if !ks.ExpiryTime.After(expiry.Add(9 * time.Minute)) {
+		t.Errorf("ExpiryTime after 304 = %v, want it extended from %v by the new max-age", ks.ExpiryTime, expiry)
+	}
+
+	// A 304 is meaningless without cached keys, so none is asked for.
+	empty := newHTTPKeySource(server.URL, server.Client())
+	empty.etag = `"v1"`
+	if err := empty.refreshKeys(context.Background()); err != nil || len(empty.CachedKeys) != 1 {
+		t.Errorf("refreshKeys() without cached keys = %v, %d keys", err, len(empty.CachedKeys))
+	}
+	if notModified != 1 {
+		t.Error("If-None-Match was sent without cached keys")
+	}
+}
+
+func TestMaxTokenLifetime(t *testing.T) {
+	now := time.Now().Unix()
+	hour := mintTestToken(t, map[string]interface{}{"iat": now, "exp": now + 3600})
+	year := mintTestToken(t, map[string]interface{}{"iat": now, "exp": now + 365*24*3600})
+	tests := []struct {
+		name    string
+		max     string
+		token   string
+		wantErr bool
+	}{
+		{"1h token, no cap", "", hour, false},
+		{"1y token, no cap", "", year, false},
+		{"1h token, 24h cap", "24h", hour, false},
+		{"1y token, 24h cap", "24h", year, true},
+		{"1h token, 30m cap", "30m", hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.MaxTokenLifetime = tt.max
+			if _, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenDetailed(t *testing.T) {
+	now := time.Now().Unix()
+	forged, err := MintToken(mustGenerateKey(), testKeyID, map[string]interface{}{
+		"iss":       idTokenIssuerPrefix + testProjectID,
+		"aud":       testProjectID,
+		"sub":       "user-1",
+		"iat":       now,
+		"exp":       now + 3600,
+		"auth_time": now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		signatureFirst bool
+		token          string
+		wantErr        bool
+		wantToken      bool
+		wantKeyID      string
+	}{
+		{"valid", false, mintTestToken(t, nil), false, true, testKeyID},
+		{"expired", false, mintTestToken(t, map[string]interface{}{"iat": now - 7200, "exp": now - 3600}), true, true, ""},
+		{"bad signature", false, forged, true, true, ""},
+		{"wrong audience", false, mintTestToken(t, map[string]interface{}{"aud": "other-project"}), true, false, ""},
+		{"malformed", false, "not-a-jwt", true, false, ""},
+		// With SignatureFirst nothing about a forged token is reported.
+		{"bad signature, SignatureFirst", true, forged, true, false, ""},
+		{"expired, SignatureFirst", true, mintTestToken(t, map[string]interface{}{"iat": now - 7200, "exp": now - 3600}), true, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.SignatureFirst = tt.signatureFirst
+			token, err := newTestPlugin(t, cfg).VerifyIDTokenDetailed(context.Background(), tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyIDTokenDetailed() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (token != nil) != tt.wantToken {
+				t.Fatalf("VerifyIDTokenDetailed() token = %+v, want one: %v", token, tt.wantToken)
+			}
+			if token == nil {
+				return
+			}
+			if token.UID != "user-1" || token.ProjectID != testProjectID {
+				t.Errorf("UID = %q, ProjectID = %q, want %q and %q", token.UID, token.ProjectID, "user-1", testProjectID)
+			}
+			// KeyID is only set once the signature has been verified.
+			if token.KeyID != tt.wantKeyID {
+				t.Errorf("KeyID = %q, want %q", token.KeyID, tt.wantKeyID)
+			}
+		})
+	}
+}
+
+func TestVerifySessionCookie(t *testing.T) {
+	now := time.Now().Unix()
+	cookieClaims := func(extra map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"iss": sessionCookieIssuerPrefix + testProjectID, "role": "admin"}
+		for name, value := range extra {
+			claims[name] = value
+		}
+		return claims
+	}
+	sessionCookie := mintTestToken(t, cookieClaims(nil))
+	idToken := mintTestToken(t, map[string]interface{}{"role": "admin"})
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+
+	token, err := plugin.VerifySessionCookie(context.Background(), sessionCookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.UID != "user-1" || token.Issuer != sessionCookieIssuerPrefix+testProjectID ||
+		token.ProjectID != testProjectID || token.Claims["role"] != "admin" {
+		t.Errorf("VerifySessionCookie() = %+v", token)
+	}
+
+	tests := []struct {
+		name    string
+		verify  func(context.Context, string) (*Token, error)
+		token   string
+		wantErr string
+	}{
+		{"ID token as a session cookie", plugin.VerifySessionCookie, idToken, "session cookie has invalid 'iss'"},
+		{"session cookie as an ID token", plugin.VerifyIDToken, sessionCookie, "ID token has invalid 'iss'"},
+		{"session cookie for another project", plugin.VerifySessionCookie,
+			mintTestToken(t, cookieClaims(map[string]interface{}{"aud": "other-project"})), "session cookie has invalid 'aud'"},
+		{"expired session cookie", plugin.VerifySessionCookie,
+			mintTestToken(t, cookieClaims(map[string]interface{}{"iat": now - 7200, "exp": now - 3600})), "session cookie has expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.verify(context.Background(), tt.token)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if token != nil {
+				t.Errorf("token = %+v returned with the error", token)
+			}
+		})
+	}
+}
+
+func TestMaxAuthAge(t *testing.T) {
+	now := time.Now().Unix()
+	recent := mintTestToken(t, map[string]interface{}{"auth_time": now - 60})
+	old := mintTestToken(t, map[string]interface{}{"auth_time": now - 3600})
+	missing := mintTestToken(t, map[string]interface{}{"auth_time": nil})
+	tests := []struct {
+		name    string
+		max     string
+		token   string
+		wantErr bool
+	}{
+		{"old sign-in, no limit", "", old, false},
+		{"missing auth_time, no limit", "", missing, false},
+		{"recent sign-in", "15m", recent, false},
+		{"old sign-in", "15m", old, true},
+		// Without auth_time the sign-in time is unknown, so it cannot be recent enough.
+		{"missing auth_time", "15m", missing, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.MaxAuthAge = tt.max
+			if _, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestForcedRefreshRateLimit(t *testing.T) {
+	keys := mustMarshal(t, map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)})
+	var fetches int
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fetches++
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Write(keys)
+	}))
+	defer server.Close()
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	plugin := newTestPlugin(t, cfg)
+	plugin.current().verifier.keySource.(*httpKeySource).KeyURI = server.URL
+
+	for i := 0; i < 50; i++ {
+		token, err := MintToken(testKey, fmt.Sprintf("unknown-%d", i), map[string]interface{}{
+			"iss": idTokenIssuerPrefix + testProjectID,
+			"aud": testProjectID,
+			"sub": "user-1",
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Unix() + 3600,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := plugin.VerifyIDToken(context.Background(), token); err == nil {
+			t.Fatal("VerifyIDToken accepted a token with an unknown kid")
+		}
+	}
+	// One fetch fills the cache, and the first unknown kid forces at most one more.
+	if fetches > 2 {
+		t.Errorf("key endpoint fetched %d times, want at most 2", fetches)
+	}
+
+	// Tokens with a known kid still verify.
+	if _, err := plugin.VerifyIDToken(context.Background(), mintTestToken(t, nil)); err != nil {
+		t.Errorf("VerifyIDToken() error = %v", err)
+	}
+}
+
+func TestInvalidForcedRefreshInterval(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.ForcedRefreshInterval = "soon"
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+		t.Error("New accepted an invalid ForcedRefreshInterval")
+	}
+}
+
+func TestEmulatorIssuer(t *testing.T) {
+	const emulatorIssuer = "http://securetoken.google.com/" + testProjectID
+	tests := []struct {
+		name     string
+		emulator bool
+		issuer   string
+		wantErr  bool
+	}{
+		{"production issuer, production mode", false, idTokenIssuerPrefix + testProjectID, false},
+		{"emulator issuer, production mode", false, emulatorIssuer, true},
+		{"emulator issuer, emulator mode", true, emulatorIssuer, false},
+		{"production issuer, emulator mode", true, idTokenIssuerPrefix + testProjectID, false},
+		{"emulator issuer for another project", true, "http://securetoken.google.com/other-project", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.EmulatorMode = tt.emulator
+			token := mintTestToken(t, map[string]interface{}{"iss": tt.issuer})
+			if _, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRefreshKeysGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(mustMarshal(t, map[string]string{testKeyID: publicKeyPEM(t, &testKey.PublicKey)}))
+	gz.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Compress whatever the client asked for, as some proxies do.
+		rw.Header().Set("Content-Encoding", "gzip")
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	for _, disableCompression := range []bool{false, true} {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		// Without compression enabled, the transport leaves gzip bodies to refreshKeys.
+		transport.DisableCompression = disableCompression
+		ks := newHTTPKeySource(server.URL, &http.Client{Transport: transport})
+		keys, err := ks.Keys(context.Background())
+		if err != nil {
+			t.Fatalf("DisableCompression=%v: Keys() error = %v", disableCompression, err)
+		}
+		if len(keys) != 1 || keys[0].Kid != testKeyID {
+			t.Errorf("DisableCompression=%v: Keys() = %v", disableCompression, keys)
+		}
+	}
+}
+
+func TestParsePublicKeysOrder(t *testing.T) {
+	pemKey := publicKeyPEM(t, &testKey.PublicKey)
+	keys := make(map[string]string)
+	for _, kid := range []string{"e", "b", "d", "a", "c", "f"} {
+		keys[kid] = pemKey
+	}
+	body := mustMarshal(t, keys)
+
+	// Map iteration order varies between runs, so parse several times.
+	for i := 0; i < 20; i++ {
+		parsed, err := parsePublicKeys(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kids []string
+		for _, k := range parsed {
+			kids = append(kids, k.Kid)
+		}
+		if got := strings.Join(kids, ""); got != "abcdef" {
+			t.Fatalf("parsePublicKeys() kids = %q, want %q", got, "abcdef")
+		}
+	}
+}
+
+func TestFutureAndPastSkew(t *testing.T) {
+	now := time.Now().Unix()
+	future := mintTestToken(t, map[string]interface{}{"iat": now + 60, "auth_time": now})
+	expired := mintTestToken(t, map[string]interface{}{"iat": now - 3600, "exp": now - 60, "auth_time": now - 3600})
+	tests := []struct {
+		name       string
+		futureSkew string
+		pastSkew   string
+		token      string
+		wantErr    bool
+	}{
+		{"issued in 1m, defaults", "", "", future, false},
+		{"expired 1m ago, defaults", "", "", expired, false},
+		{"issued in 1m, tight future skew", "10s", "", future, true},
+		{"expired 1m ago, tight future skew", "10s", "", expired, false},
+		{"issued in 1m, tight past skew", "", "10s", future, false},
+		{"expired 1m ago, tight past skew", "", "10s", expired, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.FutureSkew = tt.futureSkew
+			cfg.PastSkew = tt.pastSkew
+			if _, err := newTestPlugin(t, cfg).VerifyIDToken(context.Background(), tt.token); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
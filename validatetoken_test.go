@@ -0,0 +1,1807 @@
+package firebase_verify_token
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testProjectID = "proj-1"
+	testKeyID     = "k1"
+)
+
+// testKey signs the tokens minted by mintTestToken. Generating it once keeps the tests fast.
+var testKey = mustGenerateKey()
+
+func mustGenerateKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// mintTestToken returns an ID token for testProjectID signed with testKey. The claims in
+// extra are added to the defaults; a nil value removes the claim.
+func mintTestToken(t testing.TB, extra map[string]interface{}) string {
+	t.Helper()
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss":       idTokenIssuerPrefix + testProjectID,
+		"aud":       testProjectID,
+		"sub":       "user-1",
+		"iat":       now,
+		"exp":       now + 3600,
+		"auth_time": now,
+		"firebase":  map[string]interface{}{"sign_in_provider": "password"},
+	}
+	for name, value := range extra {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	token, err := MintToken(testKey, testKeyID, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// testKeySource serves the public half of testKey.
+func testKeySource() KeySource {
+	return NewStaticKeySource([]*PublicKey{{Kid: testKeyID, Key: &testKey.PublicKey}})
+}
+
+func TestDryRunNeverRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"no token", ""},
+		{"malformed token", "Bearer not-a-jwt"},
+		{"expired token", "Bearer " + mintTestToken(t, map[string]interface{}{"exp": time.Now().Unix() - 3600})},
+		{"wrong audience", "Bearer " + mintTestToken(t, map[string]interface{}{"aud": "other-project"})},
+	}
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.EnforceMode = enforceModeDryRun
+	cfg.RequiredClaims = map[string]interface{}{"role": "admin"}
+	forwarded := 0
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		forwarded++
+		if uid := req.Header.Get(userIDHeader); uid != "" {
+			t.Errorf("rejected request forwarded with %s %q", userIDHeader, uid)
+		}
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := forwarded
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+			if forwarded != before+1 {
+				t.Error("request was not forwarded")
+			}
+		})
+	}
+}
+
+func TestDryRunForwardsIdentity(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.EnforceMode = enforceModeDryRun
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{"role": "admin"}))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if uid := got.Get(userIDHeader); uid != "user-1" {
+		t.Errorf("%s = %q, want %q", userIDHeader, uid, "user-1")
+	}
+	if role := got.Get(claimHeaderPrefix + "role"); role != "admin" {
+		t.Errorf("%srole = %q, want %q", claimHeaderPrefix, role, "admin")
+	}
+}
+
+func TestEnforceModeRejects(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("request was forwarded")
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code < 400 {
+		t.Errorf("status = %d, want a rejection", rw.Code)
+	}
+}
+
+func TestRequireEmailVerified(t *testing.T) {
+	tests := []struct {
+		name     string
+		verified interface{}
+		want     int
+	}{
+		{"verified", true, http.StatusOK},
+		{"unverified", false, http.StatusForbidden},
+		{"missing claim", nil, http.StatusForbidden},
+		{"not a boolean", "true", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.RequireEmailVerified = true
+			cfg.JSONErrors = true
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{"email_verified": tt.verified}))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rw.Code, tt.want)
+			}
+			if tt.want == http.StatusForbidden && !strings.Contains(rw.Body.String(), errorCodeClaimDenied) {
+				t.Errorf("body = %s, want error %q", rw.Body.String(), errorCodeClaimDenied)
+			}
+		})
+	}
+}
+
+func TestNormalizeClaimName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"role", "role"},
+		{"Role", "role"},
+		{"user.role", "user-role"},
+		{"My Claim", "my-claim"},
+		{"a..b  c", "a-b-c"},
+		{"_private_", "private"},
+		{"rôle", "r-le"},
+		{"名前", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeClaimName(tt.name); got != tt.want {
+			t.Errorf("normalizeClaimName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForwardedClaimNames(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.ClaimHeaderPrefix = "fb-"
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{
+		"user role": "first",
+		"user.role": "second",
+		"My Claim":  "spaced",
+		"rôle":      "unicode",
+		"名前":        "dropped",
+		"userid":    "spoofed",
+	}))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+
+	want := map[string]string{
+		"fb-user-role": "first",
+		"fb-my-claim":  "spaced",
+		"fb-r-le":      "unicode",
+		"fb-userid":    "user-1",
+	}
+	for name, value := range want {
+		if v := got.Get(name); v != value {
+			t.Errorf("%s = %q, want %q", name, v, value)
+		}
+	}
+	for name, values := range got {
+		for _, v := range values {
+			if v == "dropped" || v == "second" {
+				t.Errorf("%s = %q should not have been forwarded", name, v)
+			}
+		}
+	}
+}
+
+func TestMaxForwardedClaims(t *testing.T) {
+	extra := make(map[string]interface{})
+	for i := 0; i < 30; i++ {
+		extra[fmt.Sprintf("c%02d", i)] = "value"
+	}
+	token := mintTestToken(t, extra)
+
+	tests := []struct {
+		name     string
+		overflow string
+	}{
+		{"truncate", claimOverflowTruncate},
+		{"json", claimOverflowJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.MaxForwardedClaims = 5
+			cfg.ClaimOverflow = tt.overflow
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+
+			var forwarded []string
+			for name := range got {
+				if strings.HasPrefix(name, http.CanonicalHeaderKey(claimHeaderPrefix)) {
+					forwarded = append(forwarded, name)
+				}
+			}
+			sort.Strings(forwarded)
+
+			if tt.overflow == claimOverflowTruncate {
+				// Claims are forwarded in key order, so the first five are kept.
+				want := []string{"Fbclaim-Auth-Time", "Fbclaim-C00", "Fbclaim-C01", "Fbclaim-C02", "Fbclaim-C03"}
+				if strings.Join(forwarded, ",") != strings.Join(want, ",") {
+					t.Errorf("forwarded claims = %v, want %v", forwarded, want)
+				}
+				return
+			}
+
+			if len(forwarded) != 0 {
+				t.Errorf("forwarded claim headers %v alongside %s", forwarded, claimsJSONHeader)
+			}
+			b, err := base64.RawURLEncoding.DecodeString(got.Get(claimsJSONHeader))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var claims map[string]interface{}
+			if err := json.Unmarshal(b, &claims); err != nil {
+				t.Fatal(err)
+			}
+			if len(claims) < 30 || claims["c29"] != "value" {
+				t.Errorf("%s holds %v, want all custom claims", claimsJSONHeader, claims)
+			}
+		})
+	}
+}
+
+func TestMaxForwardedClaimBytes(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.MaxForwardedClaimBytes = 40
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{
+		"a": "short",
+		"b": strings.Repeat("x", 100),
+	}))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if v := got.Get(claimHeaderPrefix + "a"); v != "short" {
+		t.Errorf("%sa = %q, want %q", claimHeaderPrefix, v, "short")
+	}
+	if v := got.Get(claimHeaderPrefix + "b"); v != "" {
+		t.Errorf("%sb was forwarded beyond MaxForwardedClaimBytes", claimHeaderPrefix)
+	}
+}
+
+func TestMaxForwardedClaimBytesJSONOverflow(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.MaxForwardedClaimBytes = 40
+	cfg.ClaimOverflow = claimOverflowJSON
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{
+		"a": "short",
+		"b": strings.Repeat("x", 100),
+	}))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if v := got.Get(claimHeaderPrefix + "a"); v != "" {
+		t.Errorf("%sa = %q forwarded alongside %s", claimHeaderPrefix, v, claimsJSONHeader)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(got.Get(claimsJSONHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["a"] != "short" || claims["b"] != strings.Repeat("x", 100) {
+		t.Errorf("%s holds %v, want both claims", claimsJSONHeader, claims)
+	}
+}
+
+func TestForwardClaims(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.ForwardClaims = []string{"role", "absent"}
+	cfg.ClaimHeaderMap = map[string]string{"tenant_id": "X-Tenant-ID"}
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{
+		"role":      "admin",
+		"plan":      "pro",
+		"tenant_id": "acme",
+	}))
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+
+	want := map[string]string{
+		claimHeaderPrefix + "role": "admin",
+		// Mapped claims are forwarded even though they are not listed.
+		"X-Tenant-ID": "acme",
+	}
+	for name, value := range want {
+		if v := got.Get(name); v != value {
+			t.Errorf("%s = %q, want %q", name, v, value)
+		}
+	}
+	for name := range got {
+		if strings.HasPrefix(name, http.CanonicalHeaderKey(claimHeaderPrefix)) && name != http.CanonicalHeaderKey(claimHeaderPrefix+"role") {
+			t.Errorf("%s was forwarded but is not in ForwardClaims", name)
+		}
+	}
+}
+
+func TestClaimEncoding(t *testing.T) {
+	claims := map[string]interface{}{
+		"plain": "a b/c",
+		"multi": "line1\nline2",
+		"name":  "Zoë",
+	}
+	tests := []struct {
+		name      string
+		encoding  string
+		encodings map[string]string
+		want      map[string]string
+	}{
+		{"raw", "", nil, map[string]string{
+			"plain": "a b/c",
+			"multi": "line1%0Aline2",
+			"name":  "Zo%C3%AB",
+		}},
+		{"url", claimEncodingURL, nil, map[string]string{
+			"plain": "a+b%2Fc",
+			"multi": "line1%0Aline2",
+			"name":  "Zo%C3%AB",
+		}},
+		{"base64", claimEncodingBase64, nil, map[string]string{
+			"plain": base64.RawURLEncoding.EncodeToString([]byte("a b/c")),
+			"multi": base64.RawURLEncoding.EncodeToString([]byte("line1\nline2")),
+			"name":  base64.RawURLEncoding.EncodeToString([]byte("Zoë")),
+		}},
+		{"drop", claimEncodingDrop, nil, map[string]string{
+			"plain": "",
+			"multi": "",
+			"name":  "",
+		}},
+		{"per claim", claimEncodingDrop, map[string]string{"name": claimEncodingBase64, "plain": claimEncodingRaw}, map[string]string{
+			"plain": "a b/c",
+			"multi": "",
+			"name":  base64.RawURLEncoding.EncodeToString([]byte("Zoë")),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.ClaimEncoding = tt.encoding
+			cfg.ClaimEncodings = tt.encodings
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, claims))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+			for claim, value := range tt.want {
+				values := got.Values(claimHeaderPrefix + claim)
+				if value == "" {
+					if len(values) != 0 {
+						t.Errorf("%s%s = %q, want it dropped", claimHeaderPrefix, claim, values)
+					}
+				} else if len(values) != 1 || values[0] != value {
+					t.Errorf("%s%s = %q, want %q", claimHeaderPrefix, claim, values, value)
+				}
+			}
+		})
+	}
+}
+
+// waitForGoroutines waits for the number of goroutines to drop to want, returning the last
+// count seen.
+func waitForGoroutines(want int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"BlockedUIDs": ["blocked"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The context passed to New is never cancelled, as when Traefik replaces a plugin on a
+	// configuration reload, so only Close can stop the goroutines.
+	before := runtime.NumGoroutine()
+	var plugins []*FirebaseJwtPlugin
+	for i := 0; i < 10; i++ {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.KeySource = testKeySource()
+		cfg.ConfigFile = configFile
+		cfg.ConfigFileInterval = "10ms"
+		plugins = append(plugins, newTestPlugin(t, cfg))
+	}
+	if n := runtime.NumGoroutine(); n < before+20 {
+		t.Fatalf("%d goroutines running, want the plugins' goroutines and watchers on top of %d", n, before)
+	}
+	for _, plugin := range plugins {
+		if err := plugin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := plugin.Close(); err != nil {
+			t.Fatalf("second Close: %v", err)
+		}
+	}
+	if n := waitForGoroutines(before); n > before {
+		t.Errorf("%d goroutines after Close, want at most %d", n, before)
+	}
+}
+
+func TestCloseStopsConfigFileWatcher(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.ConfigFile = configFile
+	cfg.ConfigFileInterval = "10ms"
+	plugin := newTestPlugin(t, cfg)
+	if err := plugin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(configFile, []byte(`{"BlockedUIDs": ["user-1"]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if blocked := plugin.current().blockedUIDs; len(blocked) != 0 {
+		t.Errorf("BlockedUIDs = %q, the file was applied after Close", blocked)
+	}
+}
+
+func TestContextCancellationStopsGoroutines(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 10; i++ {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.KeySource = testKeySource()
+		cfg.ConfigFile = configFile
+		cfg.ConfigFileInterval = "10ms"
+		if _, err := New(ctx, http.NotFoundHandler(), cfg, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := runtime.NumGoroutine(); n < before+10 {
+		t.Fatalf("%d goroutines running, want the plugins' goroutines on top of %d", n, before)
+	}
+	cancel()
+	if n := waitForGoroutines(before); n > before {
+		t.Errorf("%d goroutines after cancelling the context, want at most %d", n, before)
+	}
+}
+
+func TestVerifyRequestMatchesServeHTTP(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.BlockedUIDs = []string{"blocked"}
+	cfg.RequiredClaims = map[string]interface{}{"tier": "paid"}
+	cfg.Policies = []Policy{{Path: "/admin/*", RequiredClaims: map[string]interface{}{"role": "admin"}}}
+	cfg.RolesClaim = "role"
+	cfg.AllowedRoles = []string{"admin", "user"}
+	plugin := newTestPlugin(t, cfg)
+
+	tests := []struct {
+		name       string
+		path       string
+		claims     map[string]interface{}
+		noToken    bool
+		wantErr    bool
+		wantDenied bool
+	}{
+		{"allowed", "/", map[string]interface{}{"tier": "paid", "role": "user"}, false, false, false},
+		{"no token", "/", nil, true, true, false},
+		{"invalid token", "/", map[string]interface{}{"aud": "other-project"}, false, true, false},
+		{"blocked user", "/", map[string]interface{}{"sub": "blocked", "tier": "paid", "role": "user"}, false, true, true},
+		{"missing required claim", "/", map[string]interface{}{"role": "user"}, false, true, true},
+		{"policy", "/admin/x", map[string]interface{}{"tier": "paid", "role": "user"}, false, true, true},
+		{"role not allowed", "/", map[string]interface{}{"tier": "paid", "role": "guest"}, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newRequest := func() *http.Request {
+				req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				if !tt.noToken {
+					req.Header.Set("Authorization", "Bearer "+mintTestToken(t, tt.claims))
+				}
+				return req
+			}
+
+			req := newRequest()
+			before := req.Header.Clone()
+			token, err := plugin.VerifyRequest(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && token.UID != "user-1" {
+				t.Errorf("UID = %q, want %q", token.UID, "user-1")
+			}
+			var denied *authorizationError
+			if errors.As(err, &denied) != tt.wantDenied {
+				t.Errorf("VerifyRequest() error = %v, want an authorization error: %v", err, tt.wantDenied)
+			}
+			if len(req.Header) != len(before) {
+				t.Errorf("VerifyRequest modified the request headers: %v", req.Header)
+			}
+
+			want := http.StatusOK
+			switch {
+			case tt.wantDenied:
+				want = http.StatusForbidden
+			case tt.wantErr:
+				want = http.StatusUnauthorized
+			}
+			rw := httptest.NewRecorder()
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.ServeHTTP(rw, newRequest())
+			if rw.Code != want {
+				t.Errorf("ServeHTTP status = %d, want %d", rw.Code, want)
+			}
+		})
+	}
+}
+
+// unavailableKeySource simulates an outage of the public key endpoint.
+type unavailableKeySource struct{}
+
+func (unavailableKeySource) Keys(ctx context.Context) ([]*PublicKey, error) {
+	return nil, errors.New("key endpoint unreachable")
+}
+
+func TestFailOpenOnKeySourceError(t *testing.T) {
+	otherKey := mustGenerateKey()
+	forged, err := MintToken(otherKey, testKeyID, map[string]interface{}{
+		"iss": idTokenIssuerPrefix + testProjectID,
+		"aud": testProjectID,
+		"sub": "user-1",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Unix() + 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		failOpen  bool
+		keys      KeySource
+		token     string
+		wantAllow bool
+	}{
+		{"outage, valid content", true, unavailableKeySource{}, mintTestToken(t, nil), true},
+		{"outage, option off", false, unavailableKeySource{}, mintTestToken(t, nil), false},
+		{"outage, expired", true, unavailableKeySource{}, mintTestToken(t, map[string]interface{}{"exp": time.Now().Unix() - 3600}), false},
+		{"outage, wrong audience", true, unavailableKeySource{}, mintTestToken(t, map[string]interface{}{"aud": "other-project"}), false},
+		{"outage, malformed", true, unavailableKeySource{}, "not-a-jwt", false},
+		{"signature mismatch", true, testKeySource(), forged, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = tt.keys
+			cfg.FailOpenOnKeySourceError = tt.failOpen
+			forwarded := false
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = true
+				if uid := req.Header.Get(userIDHeader); uid != "" {
+					t.Errorf("unverified request forwarded with %s %q", userIDHeader, uid)
+				}
+				if _, ok := TokenFromContext(req.Context()); ok {
+					t.Error("unverified request forwarded with a token in its context")
+				}
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if forwarded != tt.wantAllow {
+				t.Errorf("forwarded = %v, want %v (status %d)", forwarded, tt.wantAllow, rw.Code)
+			}
+		})
+	}
+}
+
+func TestIdentityHeaderNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		uidHeader string
+		prefix    string
+		wantUID   string
+		wantClaim string
+	}{
+		{"defaults", "", "", userIDHeader, claimHeaderPrefix + "role"},
+		{"custom", "X-User-Id", "X-Claim-", "X-User-Id", "X-Claim-role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			if tt.uidHeader != "" {
+				cfg.UIDHeader = tt.uidHeader
+				cfg.ClaimHeaderPrefix = tt.prefix
+			}
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{"role": "admin"}))
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if v := got.Get(tt.wantUID); v != "user-1" {
+				t.Errorf("%s = %q, want %q", tt.wantUID, v, "user-1")
+			}
+			if v := got.Get(tt.wantClaim); v != "admin" {
+				t.Errorf("%s = %q, want %q", tt.wantClaim, v, "admin")
+			}
+			if tt.uidHeader != "" && got.Get(userIDHeader) != "" {
+				t.Errorf("%s set alongside the custom UIDHeader", userIDHeader)
+			}
+		})
+	}
+}
+
+func TestProjectIDHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		audiences []string
+		aud       string
+		project   string
+	}{
+		{"project audience", nil, testProjectID, testProjectID},
+		{"further project audience", nil, "proj-2", "proj-2"},
+		{"client audience", []string{"client-app"}, "client-app", testProjectID},
+		{"client audience, further project", []string{"client-app"}, "client-app", "proj-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.ProjectIDs = []string{"proj-2"}
+			cfg.Audiences = tt.audiences
+			cfg.ProjectIDHeader = "fb-project"
+			cfg.KeySource = testKeySource()
+			var got string
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header.Get("fb-project")
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{
+				"aud": tt.aud,
+				"iss": idTokenIssuerPrefix + tt.project,
+			}))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+			if got != tt.project {
+				t.Errorf("fb-project = %q, want %q", got, tt.project)
+			}
+		})
+	}
+}
+
+func TestInvalidIdentityHeaderNames(t *testing.T) {
+	for _, mod := range []func(*Config){
+		func(cfg *Config) { cfg.UIDHeader = "X User" },
+		func(cfg *Config) { cfg.ClaimHeaderPrefix = "x:claim-" },
+	} {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.KeySource = testKeySource()
+		mod(cfg)
+		if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+			t.Errorf("New accepted UIDHeader %q and ClaimHeaderPrefix %q", cfg.UIDHeader, cfg.ClaimHeaderPrefix)
+		}
+	}
+}
+
+func TestIdentityHeadersOverlappingRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		mod  func(*Config)
+	}{
+		{"claim prefix covers the token header", func(cfg *Config) {
+			cfg.HeaderName = "X-Id-Token"
+			cfg.ClaimHeaderPrefix = "X-"
+		}},
+		{"claim prefix covers X-Forwarded-*", func(cfg *Config) { cfg.ClaimHeaderPrefix = "x-forwarded-" }},
+		{"claim prefix covers Cookie", func(cfg *Config) { cfg.ClaimHeaderPrefix = "Co" }},
+		{"claim prefix covers the external key id header", func(cfg *Config) {
+			cfg.ExternalKeyIDHeader = "X-Claim-Kid"
+			cfg.ClaimHeaderPrefix = "X-Claim-"
+		}},
+		{"claim mapped to the token header", func(cfg *Config) {
+			cfg.HeaderName = "X-Id-Token"
+			cfg.ClaimHeaderMap = map[string]string{"x": "x-id-token"}
+		}},
+		{"claim mapped to Authorization", func(cfg *Config) {
+			cfg.ClaimHeaderMap = map[string]string{"x": "Authorization"}
+		}},
+		{"uid header is Cookie", func(cfg *Config) { cfg.UIDHeader = "cookie" }},
+		{"forwarded token replaces the token header", func(cfg *Config) { cfg.ForwardTokenHeader = "Authorization" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			tt.mod(cfg)
+			if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err == nil {
+				t.Error("New accepted the configuration")
+			}
+		})
+	}
+}
+
+func TestCustomTokenHeaderWithClaimPrefix(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.HeaderName = "X-Id-Token"
+	cfg.ClaimHeaderPrefix = "X-Claim-"
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Id-Token", "Bearer "+mintTestToken(t, map[string]interface{}{"role": "admin"}))
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if v := got.Get("X-Claim-Role"); v != "admin" {
+		t.Errorf("X-Claim-Role = %q, want %q", v, "admin")
+	}
+	if v := got.Get("X-Forwarded-For"); v != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For = %q, want it kept", v)
+	}
+}
+
+func TestIdentityHeadersCannotBeSpoofed(t *testing.T) {
+	forged := []string{userIDHeader, claimHeaderPrefix + "role", claimHeaderPrefix + "email", "X-Email", authnHeader, rolesHeader,
+		"X-Auth-Request-User", "X-Auth-Request-Email", "X-Auth-Request-Groups"}
+	preflight := func(req *http.Request) {
+		req.Method = http.MethodOptions
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	tests := []struct {
+		name    string
+		mod     func(*Config)
+		request func(*http.Request)
+	}{
+		{"valid token", func(*Config) {}, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, nil))
+		}},
+		{"invalid token in dry-run mode", func(cfg *Config) { cfg.EnforceMode = "dryrun" }, func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer not-a-jwt")
+		}},
+		{"optional without a token", func(cfg *Config) { cfg.Optional = true }, func(*http.Request) {}},
+		{"public route without a token", func(cfg *Config) {
+			cfg.Policies = []Policy{{Path: "/*", Public: true}}
+		}, func(*http.Request) {}},
+		{"preflight", func(cfg *Config) { cfg.AllowPreflight = true }, preflight},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.ClaimHeaderMap = map[string]string{"email": "X-Email"}
+			cfg.HeaderProfile = headerProfileOAuth2Proxy
+			tt.mod(cfg)
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, name := range forged {
+				req.Header.Set(name, "forged")
+			}
+			tt.request(req)
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if got == nil {
+				t.Fatal("request was not forwarded")
+			}
+			for _, name := range forged {
+				for _, v := range got.Values(name) {
+					if v == "forged" {
+						t.Errorf("upstream got the forged %s header", name)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestForwardExpiresIn(t *testing.T) {
+	now := time.Now().Unix()
+	tests := []struct {
+		name    string
+		forward bool
+		expires int64
+		min     int64
+		max     int64
+	}{
+		{"an hour left", true, now + 3600, 3598, 3600},
+		{"nearly expired", true, now + 5, 3, 5},
+		// Still accepted thanks to the clock skew tolerance, but clamped to zero.
+		{"expired within skew", true, now - 10, 0, 0},
+		{"disabled", false, now + 3600, -1, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.ForwardExpiresIn = tt.forward
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{"exp": tt.expires}))
+			req.Header.Set(expiresInHeader, "999999")
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+
+			value := got.Get(expiresInHeader)
+			if !tt.forward {
+				if value != "" {
+					t.Errorf("%s = %q, want it unset", expiresInHeader, value)
+				}
+				return
+			}
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seconds < tt.min || seconds > tt.max {
+				t.Errorf("%s = %q, want between %d and %d", expiresInHeader, value, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestExtractTokenTrimsQuotesAndWhitespace(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"plain", "Bearer abc.def.ghi", "abc.def.ghi"},
+		{"double quotes", `Bearer "abc.def.ghi"`, "abc.def.ghi"},
+		{"single quotes", "Bearer 'abc.def.ghi'", "abc.def.ghi"},
+		{"trailing newline", "Bearer abc.def.ghi\n", "abc.def.ghi"},
+		{"quoted and padded", "Bearer  \"abc.def.ghi\" \r\n", "abc.def.ghi"},
+		{"mismatched quotes", `Bearer "abc.def.ghi'`, `"abc.def.ghi'`},
+		{"only one pair removed", `Bearer ""abc.def.ghi""`, `"abc.def.ghi"`},
+	}
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	plugin := newTestPlugin(t, cfg)
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header["Authorization"] = []string{tt.header}
+		got, err := plugin.ExtractToken(req)
+		if err != nil {
+			t.Errorf("%s: ExtractToken() error = %v", tt.name, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%s: ExtractToken() = %q, want %q", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestQuotedTokenVerifies(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header["Authorization"] = []string{`Bearer "` + mintTestToken(t, nil) + "\"\n"}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+}
+
+func TestAuthSchemes(t *testing.T) {
+	tests := []struct {
+		name    string
+		schemes []string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"Bearer", []string{"Bearer", "firebase"}, "Bearer abc", "abc", false},
+		{"bearer", []string{"Bearer", "firebase"}, "bearer abc", "abc", false},
+		{"firebase", []string{"Bearer", "firebase"}, "Firebase abc", "abc", false},
+		{"unsupported scheme", []string{"Bearer", "firebase"}, "Token abc", "", true},
+		{"missing scheme", []string{"Bearer"}, "abc", "", true},
+		{"no schemes, raw value", []string{}, "abc", "abc", false},
+		{"no schemes, scheme is not stripped", []string{}, "Bearer abc", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.AuthSchemes = tt.schemes
+			plugin := newTestPlugin(t, cfg)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", tt.header)
+			got, err := plugin.ExtractToken(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("ExtractToken() = %q, want %q", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAuthHeader(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       []string
+		allowMultiple bool
+		want          string
+		wantErr       bool
+	}{
+		{"bearer", []string{"Bearer abc"}, false, "abc", false},
+		{"upper-case scheme", []string{"BEARER abc"}, false, "abc", false},
+		{"mixed-case scheme", []string{"bEaReR abc"}, false, "abc", false},
+		{"tab separator", []string{"Bearer\tabc"}, false, "abc", false},
+		{"extra spaces", []string{"  Bearer   abc  "}, false, "abc", false},
+		{"scheme twice", []string{"Bearer Bearer abc"}, false, "", true},
+		{"two tokens", []string{"Bearer abc def"}, false, "", true},
+		{"scheme only", []string{"Bearer"}, false, "", true},
+		{"scheme and space only", []string{"Bearer "}, false, "", true},
+		{"empty quoted credential", []string{`Bearer ""`}, false, "", true},
+		{"empty header", []string{""}, false, "", true},
+		{"repeated headers", []string{"Bearer abc", "Bearer def"}, false, "", true},
+		{"repeated headers, allowed", []string{"Bearer abc", "Bearer def"}, true, "abc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.AllowMultipleAuthHeaders = tt.allowMultiple
+			plugin := newTestPlugin(t, cfg)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, value := range tt.headers {
+				req.Header.Add("Authorization", value)
+			}
+			got, err := plugin.ExtractToken(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("ExtractToken() = %q, want %q", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBasicAuth(t *testing.T) {
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+	tests := []struct {
+		name     string
+		header   string
+		disabled bool
+		want     string
+		wantErr  bool
+	}{
+		{"user and token", basic("user-1:abc"), false, "abc", false},
+		{"empty user", basic(":abc"), false, "abc", false},
+		{"lower-case scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("user-1:abc")), false, "abc", false},
+		{"colon in token", basic("user-1:a:b"), false, "a:b", false},
+		{"malformed base64", "Basic !!!not-base64", false, "", true},
+		{"missing colon", basic("abc"), false, "", true},
+		{"empty password", basic("user-1:"), false, "", true},
+		{"empty credentials", "Basic ", false, "", true},
+		{"option off", basic("user-1:abc"), true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.AcceptBasicAuth = !tt.disabled
+			plugin := newTestPlugin(t, cfg)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", tt.header)
+			got, err := plugin.ExtractToken(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExtractToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("ExtractToken() = %q, want %q", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectionsDoNotDiscloseConfiguration(t *testing.T) {
+	tokens := map[string]string{
+		"wrong audience": mintTestToken(t, map[string]interface{}{"aud": "other-project"}),
+		"wrong issuer":   mintTestToken(t, map[string]interface{}{"iss": "https://issuer.example.com"}),
+		"expired":        mintTestToken(t, map[string]interface{}{"exp": time.Now().Unix() - 3600}),
+		"malformed":      "not-a-jwt",
+	}
+	for _, jsonErrors := range []bool{false, true} {
+		cfg := CreateConfig()
+		cfg.ProjectID = testProjectID
+		cfg.KeySource = testKeySource()
+		cfg.JSONErrors = jsonErrors
+		h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for name, token := range tokens {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusUnauthorized {
+				t.Errorf("JSONErrors=%v, %s: status = %d, want %d", jsonErrors, name, rw.Code, http.StatusUnauthorized)
+			}
+			response := rw.Body.String() + fmt.Sprint(rw.Header())
+			for _, secret := range []string{testProjectID, "other-project", "issuer.example.com", "firebase.google.com"} {
+				if strings.Contains(response, secret) {
+					t.Errorf("JSONErrors=%v, %s: response discloses %q: %s", jsonErrors, name, secret, response)
+				}
+			}
+		}
+	}
+}
+
+func TestTokenTypes(t *testing.T) {
+	authTime := time.Now().Unix()
+	idToken := mintTestToken(t, map[string]interface{}{"role": "admin", "auth_time": authTime})
+	sessionCookie := mintTestToken(t, map[string]interface{}{
+		"iss":       sessionCookieIssuerPrefix + testProjectID,
+		"role":      "admin",
+		"auth_time": authTime,
+	})
+
+	tests := []struct {
+		name    string
+		types   []string
+		token   string
+		wantErr bool
+	}{
+		{"ID token, both types", []string{tokenTypeIDToken, tokenTypeSessionCookie}, idToken, false},
+		{"session cookie, both types", []string{tokenTypeIDToken, tokenTypeSessionCookie}, sessionCookie, false},
+		{"session cookie, cookie first", []string{tokenTypeSessionCookie, tokenTypeIDToken}, sessionCookie, false},
+		{"session cookie, ID tokens only", []string{tokenTypeIDToken}, sessionCookie, true},
+		{"ID token, session cookies only", []string{tokenTypeSessionCookie}, idToken, true},
+	}
+	var headers []http.Header
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.TokenTypes = tt.types
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header.Clone()
+				got.Del("Authorization")
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if (rw.Code != http.StatusOK) != tt.wantErr {
+				t.Fatalf("status = %d, wantErr %v", rw.Code, tt.wantErr)
+			}
+			if !tt.wantErr {
+				headers = append(headers, got)
+			}
+		})
+	}
+
+	// The upstream sees the same identity whichever type matched.
+	for _, h := range headers[1:] {
+		if fmt.Sprint(h) != fmt.Sprint(headers[0]) {
+			t.Errorf("forwarded headers differ: %v and %v", h, headers[0])
+		}
+	}
+}
+
+func TestSkipOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		skipOptions bool
+		method      string
+		token       string
+		want        int
+	}{
+		{"bare OPTIONS", true, http.MethodOptions, "", http.StatusOK},
+		{"bare OPTIONS, option off", false, http.MethodOptions, "", http.StatusUnauthorized},
+		{"OPTIONS with a valid token", true, http.MethodOptions, mintTestToken(t, nil), http.StatusOK},
+		{"OPTIONS with an invalid token", true, http.MethodOptions, "not-a-jwt", http.StatusUnauthorized},
+		{"bare GET", true, http.MethodGet, "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.SkipOptions = tt.skipOptions
+			var uid string
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				uid = req.Header.Get(userIDHeader)
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(tt.method, "/", nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rw.Code, tt.want)
+			}
+			if wantUID := tt.token != "" && tt.want == http.StatusOK; (uid != "") != wantUID {
+				t.Errorf("%s = %q, want it set: %v", userIDHeader, uid, wantUID)
+			}
+		})
+	}
+}
+
+func TestAllowPreflightAndSkipOptions(t *testing.T) {
+	const (
+		skip = 1 << iota
+		allow
+		both = skip | allow
+	)
+	tests := []struct {
+		name      string
+		preflight bool
+		token     string
+		forwarded map[int]bool
+	}{
+		{"preflight without a token", true, "", map[int]bool{skip: true, allow: true, both: true}},
+		{"preflight with an invalid token", true, "not-a-jwt", map[int]bool{skip: false, allow: true, both: true}},
+		{"no CORS headers, no token", false, "", map[int]bool{skip: true, allow: false, both: true}},
+		{"no CORS headers, invalid token", false, "not-a-jwt", map[int]bool{skip: false, allow: false, both: false}},
+	}
+	for _, tt := range tests {
+		for options, want := range tt.forwarded {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.SkipOptions = options&skip != 0
+			cfg.AllowPreflight = options&allow != 0
+			var forwarded bool
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = true
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			if tt.preflight {
+				req.Header.Set("Origin", "https://app.example.com")
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			if forwarded != want {
+				t.Errorf("%s, SkipOptions=%v, AllowPreflight=%v: forwarded = %v, want %v",
+					tt.name, cfg.SkipOptions, cfg.AllowPreflight, forwarded, want)
+			}
+		}
+	}
+}
+
+func TestExternalKeyIDHeader(t *testing.T) {
+	now := time.Now().Unix()
+	noKid, err := MintToken(testKey, "", map[string]interface{}{
+		"iss": idTokenIssuerPrefix + testProjectID,
+		"aud": testProjectID,
+		"sub": "user-1",
+		"iat": now,
+		"exp": now + 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewStaticKeySource([]*PublicKey{
+		{Kid: testKeyID, Key: &testKey.PublicKey},
+		{Kid: "k2", Key: &mustGenerateKey().PublicKey},
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		kid    string
+		token  string
+		want   int
+	}{
+		{"out-of-band kid", "X-Key-Id", testKeyID, noKid, http.StatusOK},
+		{"search restricted to the supplied kid", "X-Key-Id", "k2", noKid, http.StatusUnauthorized},
+		{"unknown kid", "X-Key-Id", "k9", noKid, http.StatusUnauthorized},
+		{"no kid supplied", "X-Key-Id", "", noKid, http.StatusUnauthorized},
+		{"option off", "", testKeyID, noKid, http.StatusUnauthorized},
+		{"token kid wins", "X-Key-Id", "k2", mintTestToken(t, nil), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = keys
+			cfg.ExternalKeyIDHeader = tt.header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			if tt.kid != "" {
+				req.Header.Set("X-Key-Id", tt.kid)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.want {
+				t.Errorf("status = %d, want %d", rw.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenJSONHeader(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.TokenJSONHeader = "X-Token-Claims"
+	var got http.Header
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+mintTestToken(t, map[string]interface{}{
+		"iat":       now,
+		"exp":       now + 3600,
+		"auth_time": now - 60,
+		"role":      "admin",
+	}))
+	req.Header.Set("X-Token-Claims", "spoofed")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	b, err := base64.RawURLEncoding.DecodeString(got.Get("X-Token-Claims"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"iss":       idTokenIssuerPrefix + testProjectID,
+		"aud":       testProjectID,
+		"sub":       "user-1",
+		"uid":       "user-1",
+		"iat":       float64(now),
+		"exp":       float64(now + 3600),
+		"auth_time": float64(now - 60),
+		"role":      "admin",
+	}
+	for name, value := range want {
+		if claims[name] != value {
+			t.Errorf("claim %s = %v, want %v", name, claims[name], value)
+		}
+	}
+	if firebase, ok := claims["firebase"].(map[string]interface{}); !ok || firebase["sign_in_provider"] != "password" {
+		t.Errorf("claim firebase = %v", claims["firebase"])
+	}
+}
+
+func TestForwardAuthMethodHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []string
+		extra map[string]interface{}
+		want  string
+	}{
+		{"ID token, password", []string{tokenTypeIDToken}, nil, "id_token:password"},
+		{"session cookie, google", []string{tokenTypeSessionCookie}, map[string]interface{}{
+			"iss":      sessionCookieIssuerPrefix + testProjectID,
+			"firebase": map[string]interface{}{"sign_in_provider": "google.com"},
+		}, "session_cookie:google.com"},
+		{"no provider", []string{tokenTypeIDToken}, map[string]interface{}{"firebase": nil}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.TokenTypes = tt.types
+			cfg.ForwardAuthMethodHeader = "X-Auth-Method"
+			var got http.Header
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+mintTestToken(t, tt.extra))
+			req.Header.Set("X-Auth-Method", "spoofed")
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+			}
+			if v, ok := got["X-Auth-Method"]; got.Get("X-Auth-Method") != tt.want || (tt.want == "" && ok) {
+				t.Errorf("X-Auth-Method = %q, want %q", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnUnauthorized(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		check func(error) bool
+	}{
+		{"no token", "", func(err error) bool { return errors.Is(err, errTokenNotFound) }},
+		{"expired token", mintTestToken(t, map[string]interface{}{"exp": time.Now().Unix() - 3600}), isTokenExpired},
+		{"claim denied", mintTestToken(t, nil), func(err error) bool {
+			var denied *authorizationError
+			return errors.As(err, &denied)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, withHook := range []bool{false, true} {
+				cfg := CreateConfig()
+				cfg.ProjectID = testProjectID
+				cfg.KeySource = testKeySource()
+				cfg.RequiredClaims = map[string]interface{}{"role": "admin"}
+				var reason error
+				if withHook {
+					cfg.OnUnauthorized = func(rw http.ResponseWriter, req *http.Request, err error) {
+						reason = err
+						rw.Header().Set("Content-Type", "application/problem+json")
+						rw.WriteHeader(http.StatusTeapot)
+						fmt.Fprint(rw, `{"title":"custom"}`)
+					}
+				}
+				h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					t.Error("request was forwarded")
+				}), cfg, "test")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				if tt.token != "" {
+					req.Header.Set("Authorization", "Bearer "+tt.token)
+				}
+				rw := httptest.NewRecorder()
+				h.ServeHTTP(rw, req)
+
+				if !withHook {
+					if rw.Code != http.StatusUnauthorized && rw.Code != http.StatusForbidden {
+						t.Errorf("default status = %d, want 401 or 403", rw.Code)
+					}
+					continue
+				}
+				if rw.Code != http.StatusTeapot || rw.Body.String() != `{"title":"custom"}` {
+					t.Errorf("hook response = %d %q", rw.Code, rw.Body.String())
+				}
+				if !tt.check(reason) {
+					t.Errorf("hook called with reason %v", reason)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveQueryParam(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"z=1&sig=abc&a=2", "z=1&a=2"},
+		{"sig=abc", ""},
+		{"sig=abc&sig=def&b=1", "b=1"},
+		{"si%67=abc&b=1", "b=1"},
+		{"q=a%20b+c&sig=abc&r=%2F&&s", "q=a%20b+c&r=%2F&&s"},
+		{"signature=1&xsig=2", "signature=1&xsig=2"},
+		{"b=2&a=1", "b=2&a=1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/path?"+tt.query, nil)
+		removeQueryParam(req, "sig")
+		if req.URL.RawQuery != tt.want {
+			t.Errorf("removeQueryParam(%q) = %q, want %q", tt.query, req.URL.RawQuery, tt.want)
+		}
+		wantURI := "/path"
+		if tt.want != "" {
+			wantURI += "?" + tt.want
+		}
+		if req.RequestURI != wantURI {
+			t.Errorf("removeQueryParam(%q): RequestURI = %q, want %q", tt.query, req.RequestURI, wantURI)
+		}
+	}
+}
+
+func TestStripQueryParam(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.QueryParam = "sig"
+	cfg.StripQueryParam = true
+	var got *http.Request
+	h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req
+	}), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/files?z=1&sig="+mintTestToken(t, nil)+"&a=%2F", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rw.Code, http.StatusOK)
+	}
+	if got.URL.RawQuery != "z=1&a=%2F" || got.RequestURI != "/files?z=1&a=%2F" {
+		t.Errorf("forwarded query = %q, RequestURI = %q", got.URL.RawQuery, got.RequestURI)
+	}
+}
+
+func TestTokenSources(t *testing.T) {
+	token := mintTestToken(t, nil)
+	form := func(body string) func() *http.Request {
+		return func() *http.Request {
+			req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+			return req
+		}
+	}
+	tests := []struct {
+		name       string
+		sources    []string
+		request    func() *http.Request
+		wantStatus int
+		wantSource string
+		wantQuery  string
+		wantCookie string
+		wantBody   string
+	}{
+		{"header", nil, func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			return req
+		}, http.StatusOK, tokenSourceHeader, "", "", ""},
+		{"cookie", nil, func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+			req.AddCookie(&http.Cookie{Name: "__session", Value: token})
+			return req
+		}, http.StatusOK, tokenSourceCookie, "", "theme=dark", ""},
+		{"query", nil, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/?page=2&id_token="+token, nil)
+		}, http.StatusOK, tokenSourceQuery, "page=2", "", ""},
+		{"form", nil, form("a=1&id_token=" + token + "&b=2"), http.StatusOK, tokenSourceForm, "", "", "a=1&id_token=" + token + "&b=2"},
+		{"form with another content type", nil, func() *http.Request {
+			req := form("id_token=" + token)()
+			req.Header.Set("Content-Type", "text/plain")
+			return req
+		}, http.StatusUnauthorized, "", "", "", ""},
+		{"form body too large", nil, form("id_token=" + token + "&pad=" + strings.Repeat("x", maxFormTokenBytes)), http.StatusUnauthorized, "", "", "", ""},
+		{"header before cookie", nil, func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.AddCookie(&http.Cookie{Name: "__session", Value: "not-a-jwt"})
+			return req
+		}, http.StatusOK, tokenSourceHeader, "", "", ""},
+		{"TokenSources order", []string{tokenSourceQuery, tokenSourceHeader}, func() *http.Request {
+			req := httptest.NewRequest(http.MethodGet, "/?id_token="+token, nil)
+			req.Header.Set("Authorization", "Bearer not-a-jwt")
+			return req
+		}, http.StatusOK, tokenSourceQuery, "", "", ""},
+		{"source not listed", []string{tokenSourceHeader}, func() *http.Request {
+			return httptest.NewRequest(http.MethodGet, "/?id_token="+token, nil)
+		}, http.StatusUnauthorized, "", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.CookieName = "__session"
+			cfg.QueryParam = "id_token"
+			cfg.FormField = "id_token"
+			cfg.TokenSources = tt.sources
+			cfg.StripAuthorizationHeader = true
+			cfg.StripQueryParam = true
+			cfg.TokenSourceHeader = "X-Token-Source"
+			var got *http.Request
+			var body []byte
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req
+				body, _ = io.ReadAll(req.Body)
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, tt.request())
+			if rw.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rw.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if source := got.Header.Get("X-Token-Source"); source != tt.wantSource {
+				t.Errorf("token source = %q, want %q", source, tt.wantSource)
+			}
+			if auth := got.Header.Get("Authorization"); auth != "" {
+				t.Errorf("forwarded Authorization = %q, want it stripped", auth)
+			}
+			if cookie := got.Header.Get("Cookie"); cookie != tt.wantCookie {
+				t.Errorf("forwarded Cookie = %q, want %q", cookie, tt.wantCookie)
+			}
+			if got.URL.RawQuery != tt.wantQuery {
+				t.Errorf("forwarded query = %q, want %q", got.URL.RawQuery, tt.wantQuery)
+			}
+			// Form bodies are forwarded untouched.
+			if string(body) != tt.wantBody {
+				t.Errorf("forwarded body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestFormValueBuffersBodyOnce(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("a=1&id_token=abc"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got := formValue(req, "id_token"); got != "abc" {
+		t.Fatalf("formValue() = %q, want %q", got, "abc")
+	}
+	buffered := req.Body
+	for _, name := range []string{"id_token", "a"} {
+		formValue(req, name)
+		if req.Body != buffered {
+			t.Fatalf("formValue(%q) buffered the body again", name)
+		}
+	}
+	if got := formValue(req, "a"); got != "1" {
+		t.Errorf("formValue() = %q, want %q", got, "1")
+	}
+	if b, _ := io.ReadAll(req.Body); string(b) != "a=1&id_token=abc" {
+		t.Errorf("body = %q after formValue, want it intact", b)
+	}
+}
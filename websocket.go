@@ -0,0 +1,99 @@
+package firebase_verify_token
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const webSocketProtocolHeader = "Sec-WebSocket-Protocol"
+
+// webSocketProtocols returns the subprotocols offered in a WebSocket handshake, in order.
+func webSocketProtocols(req *http.Request) []string {
+	var protocols []string
+	for _, value := range req.Header.Values(webSocketProtocolHeader) {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// webSocketToken returns the subprotocol that follows marker in the handshake, which browsers
+// use to pass a token since they cannot set headers on WebSocket connections.
+func webSocketToken(req *http.Request, marker string) string {
+	protocols := webSocketProtocols(req)
+	for i, protocol := range protocols {
+		if protocol == marker && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// removeWebSocketToken deletes marker and the token following it from the forwarded
+// handshake. If no subprotocol is left for the upstream to select, the returned writer
+// answers the upgrade with marker so the browser accepts the connection.
+func removeWebSocketToken(rw http.ResponseWriter, req *http.Request, marker string) http.ResponseWriter {
+	protocols := webSocketProtocols(req)
+	var kept []string
+	found := false
+	for i := 0; i < len(protocols); i++ {
+		if protocols[i] == marker && !found {
+			found = true
+			i++ // skip the token
+			continue
+		}
+		kept = append(kept, protocols[i])
+	}
+	if !found {
+		return rw
+	}
+
+	req.Header.Del(webSocketProtocolHeader)
+	if len(kept) > 0 {
+		req.Header.Set(webSocketProtocolHeader, strings.Join(kept, ", "))
+		return rw
+	}
+	return &subprotocolWriter{ResponseWriter: rw, protocol: marker}
+}
+
+// subprotocolWriter selects protocol in the handshake response unless the upstream selected
+// one itself. Reverse proxies write upgrade responses through Hijack, so both paths are
+// covered.
+type subprotocolWriter struct {
+	http.ResponseWriter
+	protocol string
+}
+
+func (w *subprotocolWriter) setProtocol() {
+	if w.Header().Get(webSocketProtocolHeader) == "" {
+		w.Header().Set(webSocketProtocolHeader, w.protocol)
+	}
+}
+
+func (w *subprotocolWriter) WriteHeader(code int) {
+	if code == http.StatusSwitchingProtocols {
+		w.setProtocol()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *subprotocolWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	w.setProtocol()
+	return hijacker.Hijack()
+}
+
+func (w *subprotocolWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
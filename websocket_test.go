@@ -0,0 +1,135 @@
+package firebase_verify_token
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestWebSocketTokenRemoved(t *testing.T) {
+	token := mintTestToken(t, nil)
+	tests := []struct {
+		name      string
+		offered   string
+		wantProto string
+	}{
+		{"token and an application protocol", "access_token, " + token + ", chat", "chat"},
+		{"application protocol first", "chat, access_token, " + token, "chat"},
+		{"token only", "access_token, " + token, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			cfg.ProjectID = testProjectID
+			cfg.KeySource = testKeySource()
+			cfg.WebSocketProtocol = "access_token"
+			var got []string
+			h, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				got = req.Header.Values(webSocketProtocolHeader)
+				rw.WriteHeader(http.StatusSwitchingProtocols)
+			}), cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set(webSocketProtocolHeader, tt.offered)
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d, want %d", rw.Code, http.StatusSwitchingProtocols)
+			}
+
+			if tt.wantProto == "" {
+				if len(got) != 0 {
+					t.Errorf("upstream got %s %q, want none", webSocketProtocolHeader, got)
+				}
+				// The browser only accepts the connection if a subprotocol it offered is selected.
+				if selected := rw.Header().Get(webSocketProtocolHeader); selected != "access_token" {
+					t.Errorf("selected subprotocol = %q, want %q", selected, "access_token")
+				}
+			} else if len(got) != 1 || got[0] != tt.wantProto {
+				t.Errorf("upstream got %s %q, want %q", webSocketProtocolHeader, got, tt.wantProto)
+			}
+		})
+	}
+}
+
+// TestWebSocketHijack proxies a handshake through the middleware and a reverse proxy, which
+// writes the upgrade response through Hijack, and checks that the connection is usable.
+func TestWebSocketHijack(t *testing.T) {
+	backendProtocols := make(chan []string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		backendProtocols <- req.Header.Values(webSocketProtocolHeader)
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		// Echo one line to show that the connection is established end to end.
+		line, _ := buf.ReadString('\n')
+		fmt.Fprint(buf, line)
+		buf.Flush()
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := CreateConfig()
+	cfg.ProjectID = testProjectID
+	cfg.KeySource = testKeySource()
+	cfg.WebSocketProtocol = "access_token"
+	h, err := New(context.Background(), httputil.NewSingleHostReverseProxy(backendURL), cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s: access_token, %s\r\n\r\n",
+		webSocketProtocolHeader, mintTestToken(t, nil))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if selected := resp.Header.Get(webSocketProtocolHeader); selected != "access_token" {
+		t.Errorf("selected subprotocol = %q, want %q", selected, "access_token")
+	}
+	if got := <-backendProtocols; len(got) != 0 {
+		t.Errorf("backend got %s %q, want none", webSocketProtocolHeader, got)
+	}
+
+	fmt.Fprint(conn, "ping\n")
+	line, err := r.ReadString('\n')
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("echo = %q, want %q", line, "ping\n")
+	}
+}